@@ -0,0 +1,255 @@
+/*
+   rtldavis, an rtl-sdr receiver for Davis Instruments weather stations.
+   Copyright (C) 2015  Douglas Hall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+// Package api serves the latest readings, transmitters and reception
+// statistics as JSON over HTTP, and streams live messages as Server-Sent
+// Events.
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bemasher/rtldavis/protocol"
+	"github.com/bemasher/rtldavis/receiver"
+	"github.com/bemasher/rtldavis/weather"
+)
+
+// StreamBuffer is the number of messages buffered for each stream client.
+// Messages are dropped for clients that fall further behind.
+const StreamBuffer = 16
+
+// Reading is the latest value of a sensor.
+type Reading struct {
+	Value float64   `json:"value"`
+	Unit  string    `json:"unit,omitempty"`
+	Time  time.Time `json:"time"`
+}
+
+// Transmitter describes a transmitter and the last message heard from it.
+type Transmitter struct {
+	ID         int       `json:"id"`
+	LastSeen   time.Time `json:"last_seen"`
+	Messages   int       `json:"messages"`
+	Channel    int       `json:"channel"`
+	FreqError  int       `json:"freq_error"`
+	RSSI       float64   `json:"rssi"`
+	SNR        float64   `json:"snr"`
+	BatteryLow bool      `json:"battery_low"`
+	Sensors    []string  `json:"sensors"`
+}
+
+// Server is a sink keeping the latest reading of every sensor of each
+// transmitter and an http.Handler serving them.
+type Server struct {
+	// Stats returns the statistics served at /api/stats, if set.
+	Stats func() receiver.Stats
+
+	// Wind decodes the wind direction of each message to degrees.
+	Wind weather.Wind
+
+	mux *http.ServeMux
+
+	mu           sync.Mutex
+	current      map[int]map[string]Reading
+	conditions   map[string]Reading
+	transmitters map[int]*Transmitter
+	clients      map[chan protocol.Message]bool
+}
+
+func NewServer(stats func() receiver.Stats) *Server {
+	s := &Server{
+		Stats:        stats,
+		mux:          http.NewServeMux(),
+		current:      make(map[int]map[string]Reading),
+		transmitters: make(map[int]*Transmitter),
+		clients:      make(map[chan protocol.Message]bool),
+	}
+
+	s.mux.HandleFunc("/api/current", s.handleCurrent)
+	s.mux.HandleFunc("/api/transmitters", s.handleTransmitters)
+	s.mux.HandleFunc("/api/stats", s.handleStats)
+	s.mux.HandleFunc("/api/stream", s.handleStream)
+
+	return s
+}
+
+func (s *Server) Write(msg protocol.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := int(msg.ID)
+
+	readings, ok := s.current[id]
+	if !ok {
+		readings = make(map[string]Reading)
+		s.current[id] = readings
+	}
+	readings["wind_speed"] = Reading{float64(msg.WindSpeed), "mph", msg.Time}
+	readings["wind_direction"] = Reading{s.Wind.Direction(msg.WindDirection), "°", msg.Time}
+	if msg.Valid {
+		readings[msg.Sensor.Key()] = Reading{msg.Value, msg.Sensor.Unit(), msg.Time}
+	}
+
+	t, ok := s.transmitters[id]
+	if !ok {
+		t = &Transmitter{ID: id}
+		s.transmitters[id] = t
+	}
+	t.LastSeen = msg.Time
+	t.Messages++
+	t.Channel = msg.ChannelIdx
+	t.FreqError = msg.FreqError
+	t.RSSI = msg.RSSI
+	t.SNR = msg.SNR
+	t.BatteryLow = msg.BatteryLow
+
+	t.Sensors = t.Sensors[:0]
+	for key := range readings {
+		t.Sensors = append(t.Sensors, key)
+	}
+	sort.Strings(t.Sensors)
+
+	for c := range s.clients {
+		select {
+		case c <- msg:
+		default:
+		}
+	}
+
+	return nil
+}
+
+// WriteConditions keeps the latest derived values, wind averages, ET and rain
+// totals.
+func (s *Server) WriteConditions(c weather.Conditions) error {
+	conditions := make(map[string]Reading)
+	for _, v := range c.Values() {
+		conditions[v.Key] = Reading{v.Value, v.Unit, v.Time}
+	}
+
+	s.mu.Lock()
+	s.conditions = conditions
+	s.mu.Unlock()
+
+	return nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// writeJSON writes v as the JSON response.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	if err := enc.Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// handleCurrent serves the latest reading of every sensor keyed by
+// transmitter id and sensor, and the derived values under "conditions".
+func (s *Server) handleCurrent(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	current := make(map[string]map[string]Reading, len(s.current)+1)
+	for id, readings := range s.current {
+		key := strconv.Itoa(id)
+		current[key] = make(map[string]Reading, len(readings))
+		for sensor, reading := range readings {
+			current[key][sensor] = reading
+		}
+	}
+	if s.conditions != nil {
+		current["conditions"] = s.conditions
+	}
+	s.mu.Unlock()
+
+	writeJSON(w, current)
+}
+
+// handleTransmitters serves the transmitters heard ordered by id.
+func (s *Server) handleTransmitters(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	transmitters := make([]Transmitter, 0, len(s.transmitters))
+	for _, t := range s.transmitters {
+		c := *t
+		c.Sensors = append([]string(nil), t.Sensors...)
+		transmitters = append(transmitters, c)
+	}
+	s.mu.Unlock()
+
+	sort.Slice(transmitters, func(i, j int) bool { return transmitters[i].ID < transmitters[j].ID })
+	writeJSON(w, transmitters)
+}
+
+// handleStats serves the receiver's reception statistics.
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	if s.Stats == nil {
+		http.NotFound(w, r)
+		return
+	}
+	writeJSON(w, s.Stats())
+}
+
+// handleStream streams each message as a Server-Sent Event until the client
+// goes away.
+func (s *Server) handleStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	c := make(chan protocol.Message, StreamBuffer)
+	s.mu.Lock()
+	s.clients[c] = true
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.clients, c)
+		s.mu.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case msg := <-c:
+			buf, err := json.Marshal(msg)
+			if err != nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: message\ndata: %s\n\n", buf); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bemasher/rtldavis/dsp"
+	"github.com/bemasher/rtldavis/protocol"
+	"github.com/bemasher/rtldavis/receiver"
+	"github.com/bemasher/rtldavis/weather"
+)
+
+// Temperature of 72.5°F from transmitter 0 with 5mph wind.
+var temperature = []byte{0xCB, 0x89, 0x80, 0x05, 0x4A, 0x2D, 0x50, 0x00, 0x12, 0x34}
+
+func get(t *testing.T, url string, v interface{}) {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("%s: %s\n", url, resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAPI(t *testing.T) {
+	s := NewServer(func() receiver.Stats {
+		return receiver.Stats{Transmitters: map[int]receiver.Counts{0: {Received: 1}}}
+	})
+	s.Wind.Encoding = weather.Vue
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	msg := protocol.NewMessage(dsp.Packet{Data: temperature})
+	msg.Time = time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)
+	msg.ChannelIdx = 19
+	msg.RSSI = -20.5
+	s.Write(msg)
+	weather.NewStation(weather.NewConditions(-1, -1), s).Write(msg)
+
+	var current map[string]map[string]Reading
+	get(t, srv.URL+"/api/current", &current)
+	if r := current["0"]["temperature"]; r.Value != 72.5 || r.Unit != "°F" || !r.Time.Equal(msg.Time) {
+		t.Fatalf("bad temperature: %+v\n", r)
+	}
+	if r := current["0"]["wind_speed"]; r.Value != 5 {
+		t.Fatalf("bad wind speed: %+v\n", r)
+	}
+	if r := current["0"]["wind_direction"]; r.Value != 104.3625 || r.Unit != "°" {
+		t.Fatalf("bad wind direction: %+v\n", r)
+	}
+	if r := current["conditions"]["wind_chill"]; r.Unit != "°F" || !r.Time.Equal(msg.Time) {
+		t.Fatalf("bad wind chill: %+v\n", r)
+	}
+
+	var transmitters []Transmitter
+	get(t, srv.URL+"/api/transmitters", &transmitters)
+	if len(transmitters) != 1 {
+		t.Fatalf("expected 1 transmitter, got %d\n", len(transmitters))
+	}
+	if tx := transmitters[0]; tx.ID != 0 || tx.Messages != 1 || tx.Channel != 19 || tx.RSSI != -20.5 || len(tx.Sensors) != 3 {
+		t.Fatalf("bad transmitter: %+v\n", tx)
+	}
+
+	var stats receiver.Stats
+	get(t, srv.URL+"/api/stats", &stats)
+	if stats.Transmitters[0].Received != 1 {
+		t.Fatalf("bad stats: %+v\n", stats)
+	}
+}
+
+func TestStream(t *testing.T) {
+	s := NewServer(nil)
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/api/stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("bad content type: %q\n", ct)
+	}
+
+	// The client is registered before the headers are sent.
+	msg := protocol.NewMessage(dsp.Packet{Data: temperature})
+	s.Write(msg)
+
+	r := bufio.NewReader(resp.Body)
+	if line, err := r.ReadString('\n'); err != nil || line != "event: message\n" {
+		t.Fatalf("expected event line, got %q %v\n", line, err)
+	}
+
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	var event struct {
+		Sensor string  `json:"sensor"`
+		Value  float64 `json:"value"`
+	}
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Sensor != "Temperature" || event.Value != 72.5 {
+		t.Fatalf("bad event: %+v\n", event)
+	}
+}
@@ -133,6 +133,11 @@ func (d *Demodulator) Search() (indexes []int) {
 type Packet struct {
 	Idx  int
 	Data []byte
+
+	// RSSI is the mean power of the filtered samples spanning the packet in
+	// dBFS and SNR its ratio to the noise floor in dB.
+	RSSI float64
+	SNR  float64
 }
 
 func (d *Demodulator) Slice(indices []int) (pkts []Packet) {
@@ -159,7 +164,9 @@ func (d *Demodulator) Slice(indices []int) (pkts []Packet) {
 		if !seen[pktStr] {
 			seen[pktStr] = true
 
-			pkt := Packet{qIdx, make([]byte, len(d.pkt))}
+			pkt := Packet{Idx: qIdx, Data: make([]byte, len(d.pkt))}
+			pkt.RSSI = d.Power(qIdx, d.Cfg.PacketLength)
+			pkt.SNR = pkt.RSSI - decibels(d.NoiseFloor)
 			copy(pkt.Data, d.pkt)
 			pkts = append(pkts, pkt)
 		}
@@ -168,6 +175,43 @@ func (d *Demodulator) Slice(indices []int) (pkts []Packet) {
 	return
 }
 
+// Power returns the mean power in dBFS of length filtered samples starting at
+// idx, indexed the same as Quantized.
+func (d *Demodulator) Power(idx, length int) float64 {
+	var power float64
+	for _, mag := range d.Magnitude[idx : idx+length] {
+		power += mag
+	}
+	return decibels(power / float64(length))
+}
+
+// minPower keeps decibels finite for silent input.
+const minPower = 1e-12
+
+// decibels converts a power relative to full scale to dBFS.
+func decibels(power float64) float64 {
+	return 10 * math.Log10(math.Max(power, minPower))
+}
+
+// noiseFloorRise is the number of blocks the noise floor takes to rise most
+// of the way to a louder level.
+const noiseFloorRise = 256
+
+// updateNoiseFloor tracks the quietest block power seen. It drops to a
+// quieter block immediately and rises slowly in dB otherwise, so the short
+// bursts of a packet hardly move it.
+func (d *Demodulator) updateNoiseFloor(power float64) {
+	if power == 0 {
+		// The buffer hasn't filled yet.
+		return
+	}
+	if d.NoiseFloor == 0 || power < d.NoiseFloor {
+		d.NoiseFloor = power
+		return
+	}
+	d.NoiseFloor *= math.Pow(power/d.NoiseFloor, 1.0/noiseFloorRise)
+}
+
 // PacketConfig specifies packet-specific radio configuration.
 type PacketConfig struct {
 	BitRate                        int
@@ -239,6 +283,12 @@ type Demodulator struct {
 	Discriminated []float64
 	Quantized     []byte
 
+	// Magnitude is the squared magnitude of the filtered samples, aligned
+	// with Quantized. NoiseFloor is the estimated noise power of the
+	// filtered samples relative to full scale.
+	Magnitude  []float64
+	NoiseFloor float64
+
 	slices [][]byte
 	pkt    []byte
 
@@ -253,6 +303,7 @@ func NewDemodulator(cfg *PacketConfig) (d Demodulator) {
 	d.Filtered = make([]complex128, d.Cfg.BlockSize+1)
 	d.Discriminated = make([]float64, d.Cfg.BlockSize*2)
 	d.Quantized = make([]byte, d.Cfg.BufferLength)
+	d.Magnitude = make([]float64, d.Cfg.BufferLength)
 
 	d.slices = make([][]byte, d.Cfg.SymbolLength)
 	flat := make([]byte, d.Cfg.BufferLength-(d.Cfg.BufferLength%d.Cfg.SymbolLength))
@@ -280,6 +331,15 @@ func (d *Demodulator) Demodulate(input []byte) []Packet {
 	copy(d.Discriminated, d.Discriminated[d.Cfg.BlockSize:])
 	copy(d.Quantized, d.Quantized[d.Cfg.BlockSize:])
 
+	// The noise floor is measured on the block leaving the buffer so it
+	// only includes samples from before any packet found in the buffer.
+	var power float64
+	for _, mag := range d.Magnitude[:d.Cfg.BlockSize] {
+		power += mag
+	}
+	d.updateNoiseFloor(power / float64(d.Cfg.BlockSize))
+	copy(d.Magnitude, d.Magnitude[d.Cfg.BlockSize:])
+
 	copy(d.Raw[d.Cfg.BufferLength<<1-d.Cfg.BlockSize2:], input)
 
 	d.lut.Execute(d.Raw[d.Cfg.BufferLength<<1-d.Cfg.BlockSize2:], d.IQ[9:])
@@ -287,6 +347,12 @@ func (d *Demodulator) Demodulate(input []byte) []Packet {
 	FIR9(d.IQ, d.Filtered[1:])
 	Discriminate(d.Filtered, d.Discriminated[d.Cfg.BlockSize:])
 	Quantize(d.Discriminated[d.Cfg.BlockSize:], d.Quantized[d.Cfg.BufferLength-d.Cfg.BlockSize:])
+
+	magnitude := d.Magnitude[d.Cfg.BufferLength-d.Cfg.BlockSize:]
+	for idx, sample := range d.Filtered[1:] {
+		magnitude[idx] = real(sample)*real(sample) + imag(sample)*imag(sample)
+	}
+
 	d.Pack(d.Quantized)
 	return d.Slice(d.Search())
 }
@@ -307,4 +373,8 @@ func (d *Demodulator) Reset() {
 	for idx := range d.Quantized {
 		d.Quantized[idx] = 0
 	}
+	for idx := range d.Magnitude {
+		d.Magnitude[idx] = 0
+	}
+	d.NoiseFloor = 0
 }
@@ -0,0 +1,285 @@
+/*
+   rtldavis, an rtl-sdr receiver for Davis Instruments weather stations.
+   Copyright (C) 2015  Douglas Hall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package influx
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/bemasher/rtldavis/protocol"
+	"github.com/bemasher/rtldavis/weather"
+)
+
+// ErrQueueFull is returned by Write when messages arrive faster than they
+// can be batched, usually because a request is blocked on the server.
+var ErrQueueFull = errors.New("influx: write queue full")
+
+// Options configures a Client.
+type Options struct {
+	// URL is the write endpoint, e.g. http://localhost:8086/write?db=weather
+	// for InfluxDB 1.x or
+	// http://localhost:8086/api/v2/write?org=home&bucket=weather for 2.x.
+	// Timestamps are in nanoseconds, the default precision of both.
+	URL string
+
+	// Token is sent as the Authorization header if not empty, e.g.
+	// "Token <token>" for 2.x or "Basic <credentials>" for 1.x.
+	Token string
+
+	Measurement string
+
+	// Wind decodes the wind direction of each message to degrees.
+	Wind weather.Wind
+
+	// Lines are sent in batches of up to BatchSize lines, or whatever has
+	// been buffered FlushInterval after the first line of a batch.
+	BatchSize     int
+	FlushInterval time.Duration
+
+	// A failed batch is retried after MinBackoff, doubling the wait after
+	// each failed attempt up to MaxBackoff. Lines are dropped, oldest first,
+	// if more than MaxBuffered are waiting to be sent.
+	MinBackoff, MaxBackoff time.Duration
+	MaxBuffered            int
+
+	// QueueLength is the number of messages waiting to be batched.
+	QueueLength int
+
+	// Timeout limits each request.
+	Timeout time.Duration
+
+	// Logger receives write errors, discarded if nil.
+	Logger *log.Logger
+}
+
+// DefaultOptions returns options for writing to the given URL.
+func DefaultOptions(url string) Options {
+	return Options{
+		URL:           url,
+		Measurement:   Measurement,
+		BatchSize:     100,
+		FlushInterval: 10 * time.Second,
+		MinBackoff:    time.Second,
+		MaxBackoff:    2 * time.Minute,
+		MaxBuffered:   10000,
+		QueueLength:   256,
+		Timeout:       10 * time.Second,
+	}
+}
+
+// Client is a sink writing line protocol to an InfluxDB server over HTTP.
+// Lines are batched and sent from a background goroutine which retries with
+// exponential backoff while the server is unreachable.
+type Client struct {
+	opts   Options
+	client *http.Client
+
+	queue chan []byte
+	done  chan struct{}
+	exit  chan struct{}
+}
+
+// NewClient returns a client and starts its background writer.
+func NewClient(opts Options) *Client {
+	if opts.Logger == nil {
+		opts.Logger = log.New(ioutil.Discard, "", 0)
+	}
+
+	c := &Client{
+		opts:   opts,
+		client: &http.Client{Timeout: opts.Timeout},
+		queue:  make(chan []byte, opts.QueueLength),
+		done:   make(chan struct{}),
+		exit:   make(chan struct{}),
+	}
+	go c.run()
+
+	return c
+}
+
+// Write queues the lines of msg to be sent.
+func (c *Client) Write(msg protocol.Message) error {
+	select {
+	case c.queue <- AppendLines(nil, c.opts.Measurement, c.opts.Wind, msg):
+		return nil
+	default:
+		return ErrQueueFull
+	}
+}
+
+// WriteConditions queues the lines of the current conditions, see Write.
+func (c *Client) WriteConditions(cond weather.Conditions) error {
+	lines := AppendConditions(nil, c.opts.Measurement, cond)
+	if len(lines) == 0 {
+		return nil
+	}
+
+	select {
+	case c.queue <- lines:
+		return nil
+	default:
+		return ErrQueueFull
+	}
+}
+
+// Close sends whatever is buffered, making one attempt, and stops the
+// background writer.
+func (c *Client) Close() error {
+	close(c.done)
+	<-c.exit
+	return nil
+}
+
+// statusError is an unsuccessful response from the server.
+type statusError struct {
+	code int
+	body string
+}
+
+func (e statusError) Error() string {
+	return fmt.Sprintf("influx: %d %s: %s", e.code, http.StatusText(e.code), e.body)
+}
+
+// retry reports whether a failed write is worth retrying. Requests the server
+// rejected as malformed will be rejected again.
+func retryable(err error) bool {
+	if s, ok := err.(statusError); ok {
+		return s.code == http.StatusTooManyRequests || s.code >= 500
+	}
+	return true
+}
+
+func (c *Client) run() {
+	defer close(c.exit)
+
+	var (
+		buf   []byte
+		lines int
+		flush <-chan time.Time
+		retry <-chan time.Time
+	)
+	backoff := c.opts.MinBackoff
+
+	// send attempts to write the buffered lines, on failure they're kept
+	// and retried after a backoff.
+	send := func() {
+		flush = nil
+		if lines == 0 {
+			return
+		}
+
+		err := c.post(buf)
+		if err == nil || !retryable(err) {
+			if err != nil {
+				c.opts.Logger.Printf("%s, dropping %d lines\n", err, lines)
+			}
+			buf, lines = buf[:0], 0
+			backoff = c.opts.MinBackoff
+			return
+		}
+
+		c.opts.Logger.Printf("%s, retrying in %s\n", err, backoff)
+		retry = time.After(backoff)
+		if backoff *= 2; backoff > c.opts.MaxBackoff {
+			backoff = c.opts.MaxBackoff
+		}
+	}
+
+	for {
+		select {
+		case msg := <-c.queue:
+			buf = append(buf, msg...)
+			lines += bytes.Count(msg, []byte{'\n'})
+
+			// Drop the oldest lines rather than grow without bound while
+			// the server is unreachable.
+			for lines > c.opts.MaxBuffered {
+				buf = buf[bytes.IndexByte(buf, '\n')+1:]
+				lines--
+			}
+
+			// While waiting to retry keep buffering.
+			if retry != nil {
+				continue
+			}
+			if lines >= c.opts.BatchSize {
+				send()
+			} else if flush == nil {
+				flush = time.After(c.opts.FlushInterval)
+			}
+
+		case <-flush:
+			send()
+
+		case <-retry:
+			retry = nil
+			send()
+
+		case <-c.done:
+			// Drain anything queued and make a last attempt.
+		drain:
+			for {
+				select {
+				case msg := <-c.queue:
+					buf = append(buf, msg...)
+					lines += bytes.Count(msg, []byte{'\n'})
+				default:
+					break drain
+				}
+			}
+			if lines > 0 {
+				if err := c.post(buf); err != nil {
+					c.opts.Logger.Printf("%s, dropping %d lines\n", err, lines)
+				}
+			}
+			return
+		}
+	}
+}
+
+// post writes a batch of lines to the server.
+func (c *Client) post(buf []byte) error {
+	req, err := http.NewRequest("POST", c.opts.URL, bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if c.opts.Token != "" {
+		req.Header.Set("Authorization", c.opts.Token)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return statusError{resp.StatusCode, string(bytes.TrimSpace(body))}
+	}
+
+	io.Copy(ioutil.Discard, resp.Body)
+	return nil
+}
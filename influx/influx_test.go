@@ -0,0 +1,193 @@
+package influx
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bemasher/rtldavis/dsp"
+	"github.com/bemasher/rtldavis/protocol"
+	"github.com/bemasher/rtldavis/weather"
+)
+
+func testMessage() protocol.Message {
+	msg := protocol.NewMessage(dsp.Packet{Data: []byte{0xCB, 0x89, 0x81, 0x05, 0x4A, 0x2D, 0x50, 0x00, 0x12, 0x34}})
+	msg.Time = time.Unix(1433160000, 123)
+	return msg
+}
+
+const testLines = "davis,id=1,sensor=wind_speed value=5 1433160000000000123\n" +
+	"davis,id=1,sensor=wind_direction value=104.3625 1433160000000000123\n" +
+	"davis,id=1,sensor=temperature value=72.5 1433160000000000123\n"
+
+func TestWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf, Measurement, weather.Wind{Encoding: weather.Vue})
+	if err := w.Write(testMessage()); err != nil {
+		t.Fatal(err)
+	}
+
+	if buf.String() != testLines {
+		t.Fatalf("expected:\n%s\ngot:\n%s\n", testLines, buf.String())
+	}
+
+	// Invalid readings only carry wind.
+	msg := testMessage()
+	msg.Valid = false
+	line := string(AppendLines(nil, "my weather,x", weather.Wind{Encoding: weather.Vue}, msg))
+	expected := `my\ weather\,x,id=1,sensor=wind_speed value=5 1433160000000000123` + "\n" +
+		`my\ weather\,x,id=1,sensor=wind_direction value=104.3625 1433160000000000123` + "\n"
+	if line != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s\n", expected, line)
+	}
+
+	c := weather.NewConditions(-1, -1)
+	c.WindChill = weather.Reading{Value: 71.5, Time: msg.Time}
+	line = string(AppendConditions(nil, Measurement, c))
+	expected = `davis,sensor=wind_chill value=71.5 1433160000000000123` + "\n"
+	if line != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s\n", expected, line)
+	}
+}
+
+// server is a stand-in for InfluxDB recording the body of each write,
+// responding to each with the next of its status codes, then 204.
+type server struct {
+	*httptest.Server
+
+	sync.Mutex
+	codes  []int
+	bodies []string
+	auth   string
+	writes chan struct{}
+}
+
+func newServer(codes ...int) *server {
+	s := &server{codes: codes, writes: make(chan struct{}, 16)}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+
+		s.Lock()
+		s.auth = r.Header.Get("Authorization")
+		s.bodies = append(s.bodies, string(body))
+		code := http.StatusNoContent
+		if len(s.codes) > 0 {
+			code, s.codes = s.codes[0], s.codes[1:]
+		}
+		s.Unlock()
+
+		w.WriteHeader(code)
+		s.writes <- struct{}{}
+	}))
+	return s
+}
+
+func (s *server) wait(t *testing.T, n int) []string {
+	for idx := 0; idx < n; idx++ {
+		select {
+		case <-s.writes:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for write %d\n", idx+1)
+		}
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	return append([]string{}, s.bodies...)
+}
+
+func testOptions(url string) Options {
+	opts := DefaultOptions(url)
+	opts.BatchSize = 6
+	opts.FlushInterval = time.Hour
+	opts.MinBackoff = 10 * time.Millisecond
+	opts.MaxBackoff = 10 * time.Millisecond
+	opts.Wind.Encoding = weather.Vue
+	return opts
+}
+
+func TestClientBatch(t *testing.T) {
+	s := newServer()
+	defer s.Close()
+
+	opts := testOptions(s.URL)
+	opts.Token = "Token secret"
+	c := NewClient(opts)
+	defer c.Close()
+
+	// Two messages fill a batch of six lines.
+	for idx := 0; idx < 2; idx++ {
+		if err := c.Write(testMessage()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	bodies := s.wait(t, 1)
+	if bodies[0] != testLines+testLines {
+		t.Fatalf("expected:\n%s\ngot:\n%s\n", testLines+testLines, bodies[0])
+	}
+	if s.auth != "Token secret" {
+		t.Fatalf("expected Authorization %q, got %q\n", "Token secret", s.auth)
+	}
+}
+
+func TestClientFlush(t *testing.T) {
+	s := newServer()
+	defer s.Close()
+
+	opts := testOptions(s.URL)
+	opts.FlushInterval = 10 * time.Millisecond
+	c := NewClient(opts)
+	defer c.Close()
+
+	c.Write(testMessage())
+	if bodies := s.wait(t, 1); bodies[0] != testLines {
+		t.Fatalf("expected:\n%s\ngot:\n%s\n", testLines, bodies[0])
+	}
+}
+
+func TestClientRetry(t *testing.T) {
+	// A server error is retried, a rejected batch is dropped.
+	s := newServer(http.StatusInternalServerError, http.StatusServiceUnavailable, http.StatusBadRequest)
+	defer s.Close()
+
+	c := NewClient(testOptions(s.URL))
+	defer c.Close()
+
+	c.Write(testMessage())
+	c.Write(testMessage())
+	bodies := s.wait(t, 3)
+	for idx, body := range bodies {
+		if body != testLines+testLines {
+			t.Fatalf("expected write %d to retry the batch, got:\n%s\n", idx, body)
+		}
+	}
+
+	msg := testMessage()
+	msg.Valid = false
+	c.Write(msg)
+	c.Write(msg)
+	c.Write(msg)
+	bodies = s.wait(t, 1)
+	if last := bodies[len(bodies)-1]; strings.Count(last, "\n") != 6 || strings.Contains(last, "temperature") {
+		t.Fatalf("expected rejected batch to be dropped, got:\n%s\n", last)
+	}
+}
+
+func TestClientClose(t *testing.T) {
+	s := newServer()
+	defer s.Close()
+
+	c := NewClient(testOptions(s.URL))
+	c.Write(testMessage())
+	c.Close()
+
+	if bodies := s.wait(t, 1); bodies[0] != testLines {
+		t.Fatalf("expected buffered lines to be sent on close, got:\n%s\n", bodies[0])
+	}
+}
@@ -0,0 +1,105 @@
+/*
+   rtldavis, an rtl-sdr receiver for Davis Instruments weather stations.
+   Copyright (C) 2015  Douglas Hall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+// Package influx writes decoded readings in InfluxDB line protocol, to a
+// stream or to an InfluxDB server over HTTP.
+package influx
+
+import (
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/bemasher/rtldavis/protocol"
+	"github.com/bemasher/rtldavis/weather"
+)
+
+// Measurement is the default measurement readings are written to.
+const Measurement = "davis"
+
+var (
+	measurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	tagEscaper         = strings.NewReplacer(",", `\,`, " ", `\ `, "=", `\=`)
+)
+
+// AppendLines appends a line for each reading carried by msg to buf: wind
+// speed, direction in degrees decoded by wind and, if valid, the sensor's
+// reading. Each line is tagged with the transmitter id and sensor and
+// timestamped in nanoseconds.
+func AppendLines(buf []byte, measurement string, wind weather.Wind, msg protocol.Message) []byte {
+	appendLine := func(sensor string, value float64) {
+		buf = append(buf, measurementEscaper.Replace(measurement)...)
+		buf = append(buf, ",id="...)
+		buf = strconv.AppendInt(buf, int64(msg.ID), 10)
+		buf = append(buf, ",sensor="...)
+		buf = append(buf, tagEscaper.Replace(sensor)...)
+		buf = append(buf, " value="...)
+		buf = strconv.AppendFloat(buf, value, 'f', -1, 64)
+		buf = append(buf, ' ')
+		buf = strconv.AppendInt(buf, msg.Time.UnixNano(), 10)
+		buf = append(buf, '\n')
+	}
+
+	appendLine("wind_speed", float64(msg.WindSpeed))
+	appendLine("wind_direction", wind.Direction(msg.WindDirection))
+	if msg.Valid {
+		appendLine(msg.Sensor.Key(), msg.Value)
+	}
+
+	return buf
+}
+
+// AppendConditions appends a line for each of the derived values, wind
+// averages, ET and rain totals of the current conditions to buf, tagged with
+// the value's key as the sensor.
+func AppendConditions(buf []byte, measurement string, c weather.Conditions) []byte {
+	for _, v := range c.Values() {
+		buf = append(buf, measurementEscaper.Replace(measurement)...)
+		buf = append(buf, ",sensor="...)
+		buf = append(buf, tagEscaper.Replace(v.Key)...)
+		buf = append(buf, " value="...)
+		buf = strconv.AppendFloat(buf, v.Value, 'f', -1, 64)
+		buf = append(buf, ' ')
+		buf = strconv.AppendInt(buf, v.Time.UnixNano(), 10)
+		buf = append(buf, '\n')
+	}
+	return buf
+}
+
+// Writer writes line protocol to a stream such as a file or stdout.
+type Writer struct {
+	w           io.Writer
+	measurement string
+	wind        weather.Wind
+	buf         []byte
+}
+
+func NewWriter(w io.Writer, measurement string, wind weather.Wind) *Writer {
+	return &Writer{w: w, measurement: measurement, wind: wind}
+}
+
+func (w *Writer) Write(msg protocol.Message) error {
+	w.buf = AppendLines(w.buf[:0], w.measurement, w.wind, msg)
+	_, err := w.w.Write(w.buf)
+	return err
+}
+
+func (w *Writer) WriteConditions(c weather.Conditions) error {
+	w.buf = AppendConditions(w.buf[:0], w.measurement, c)
+	_, err := w.w.Write(w.buf)
+	return err
+}
@@ -18,35 +18,220 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"math/rand"
+	"net/http"
 	"os"
 	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
 	"time"
 
+	"github.com/bemasher/rtldavis/api"
+	"github.com/bemasher/rtldavis/influx"
+	"github.com/bemasher/rtldavis/metrics"
+	"github.com/bemasher/rtldavis/mqtt"
+	"github.com/bemasher/rtldavis/output"
 	"github.com/bemasher/rtldavis/protocol"
-	"github.com/jpoirier/gortlsdr"
+	"github.com/bemasher/rtldavis/receiver"
+	"github.com/bemasher/rtldavis/source"
+	"github.com/bemasher/rtldavis/vantage"
+	"github.com/bemasher/rtldavis/weather"
 )
 
 var (
-	id      *int
-	verbose *bool
+	ids       idList
+	repeaters repeaterList
+	input     *string
+	tcpAddr   *string
+	record    *string
+	format    *string
+	verbose   *bool
+
+	mqttAddr      *string
+	mqttPrefix    *string
+	mqttRetain    *bool
+	mqttUser      *string
+	mqttPassFile  *string
+	mqttDiscovery *string
+
+	influxURL   *string
+	influxToken *string
+
+	vantageAddr  *string
+	condFile     *string
+	issID        *int
+	windID       *int
+	windEncoding *string
+	windOffset   *float64
+	rainFile     *string
+	rainBucket   *string
+
+	band *string
+
+	httpAddr *string
+
+	stateFile     *string
+	stateInterval *time.Duration
+
+	statsInterval *time.Duration
+
+	superCapLow *float64
+
+	scan            *time.Duration
+	scanChannelTime *time.Duration
 
 	verboseLogger *log.Logger
 )
 
+// idList is a flag.Value accepting a comma-separated list of transmitter ids.
+type idList []int
+
+func (l idList) String() string {
+	s := make([]string, len(l))
+	for idx, id := range l {
+		s[idx] = strconv.Itoa(id)
+	}
+	return strings.Join(s, ",")
+}
+
+func (l idList) contains(id int) bool {
+	for _, i := range l {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *idList) Set(value string) error {
+	for _, field := range strings.Split(value, ",") {
+		id, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil {
+			return err
+		}
+		if id < 0 || id >= protocol.MaxTransmitters {
+			return fmt.Errorf("id out of range [0,%d): %d", protocol.MaxTransmitters, id)
+		}
+		for _, seen := range *l {
+			if seen == id {
+				return fmt.Errorf("duplicate id: %d", id)
+			}
+		}
+		*l = append(*l, id)
+	}
+	if len(*l) > protocol.MaxTransmitters {
+		return fmt.Errorf("too many ids, at most %d", protocol.MaxTransmitters)
+	}
+	return nil
+}
+
+// repeaterList is a flag.Value accepting a comma-separated list of
+// id=repeater pairs.
+type repeaterList map[int]protocol.Repeater
+
+func (l repeaterList) String() string {
+	s := make([]string, 0, len(l))
+	for id, repeater := range l {
+		s = append(s, fmt.Sprintf("%d=%s", id, repeater))
+	}
+	sort.Strings(s)
+	return strings.Join(s, ",")
+}
+
+func (l *repeaterList) Set(value string) error {
+	if *l == nil {
+		*l = make(repeaterList)
+	}
+	for _, field := range strings.Split(value, ",") {
+		pair := strings.SplitN(field, "=", 2)
+		if len(pair) != 2 {
+			return fmt.Errorf("expected id=repeater: %q", field)
+		}
+		id, err := strconv.Atoi(strings.TrimSpace(pair[0]))
+		if err != nil {
+			return err
+		}
+		if id < 0 || id >= protocol.MaxTransmitters {
+			return fmt.Errorf("id out of range [0,%d): %d", protocol.MaxTransmitters, id)
+		}
+		repeater, err := protocol.ParseRepeater(pair[1])
+		if err != nil {
+			return err
+		}
+		(*l)[id] = repeater
+	}
+	return nil
+}
+
 func init() {
 	log.SetFlags(log.Lmicroseconds)
 	rand.Seed(time.Now().UnixNano())
 
-	id = flag.Int("id", 0, "id of the station to listen for")
+	flag.Var(&ids, "id", "comma-separated list of transmitter ids to listen for")
+	flag.Var(&repeaters, "repeater", "experimental: comma-separated list of id=repeater pairs listening for a transmitter through a repeater, e.g. 1=A")
+	input = flag.String("in", "", "replay raw 8-bit IQ samples from a file instead of a dongle, - for stdin")
+	tcpAddr = flag.String("tcp", "", "read samples from an rtl_tcp server at host:port instead of a local dongle")
+	record = flag.String("record", "", "record raw 8-bit IQ samples to a file, hops are written to file.hops")
+	format = flag.String("format", "text", "format of decoded messages written to stdout: text, json or influx")
+	mqttAddr = flag.String("mqtt", "", "publish decoded messages to the MQTT broker at host:port")
+	mqttPrefix = flag.String("mqtt-prefix", "rtldavis", "topic prefix for published messages")
+	mqttRetain = flag.Bool("mqtt-retain", false, "publish messages with the retain flag set")
+	mqttUser = flag.String("mqtt-user", "", "MQTT user name")
+	mqttPassFile = flag.String("mqtt-pass-file", "", "read the MQTT password from this file instead of $RTLDAVIS_MQTT_PASSWORD")
+	mqttDiscovery = flag.String("mqtt-discovery", "", "publish Home Assistant discovery payloads under this prefix, e.g. homeassistant")
+	vantageAddr = flag.String("vantage", "", "serve the Vantage console serial protocol on this TCP address, e.g. :22222")
+	condFile = flag.String("conditions", "", "write derived values, wind averages, ET and rain totals as JSON lines to this file, - for stdout")
+	issID = flag.Int("iss-id", -1, "id of the transmitter outside temperature, humidity, rain, UV and solar readings are taken from, defaults to the first -id")
+	windID = flag.Int("wind-id", -1, "id of the transmitter wind readings are taken from, defaults to -iss-id")
+	windEncoding = flag.String("wind-encoding", "pro2", "wind direction encoding of the anemometer: pro2 or vue")
+	windOffset = flag.Float64("wind-offset", 0, "degrees added to wind direction to correct an anemometer not aligned with north")
+	rainFile = flag.String("rain", "", "save rain totals to this file and resume from it on start")
+	rainBucket = flag.String("rain-bucket", "0.01in", "rain collector bucket size: 0.01in or 0.2mm")
+	band = flag.String("band", "us", "frequency plan of the transmitters: us, eu, au or nz")
+	influxURL = flag.String("influx", "", "write readings to this InfluxDB write endpoint, e.g. http://localhost:8086/write?db=weather")
+	influxToken = flag.String("influx-token", "", "Authorization header sent to InfluxDB, e.g. \"Token <token>\"")
+	httpAddr = flag.String("http", "", "serve Prometheus metrics at /metrics and the JSON API at /api/ on this address, e.g. :8080")
+	stateFile = flag.String("state", "", "save hop synchronization and frequency errors to this file and resume from it on start")
+	stateInterval = flag.Duration("state-interval", time.Minute, "how often to save state and rain totals")
+	superCapLow = flag.Float64("supercap-low", 0, "log an alert when a transmitter's supercap voltage falls below this, e.g. 1.5")
+	statsInterval = flag.Duration("stats", 0, "log reception statistics of each transmitter at this interval, e.g. 10m")
+	scan = flag.Duration("scan", 0, "listen for any transmitter for this long and report those heard instead of following -id")
+	scanChannelTime = flag.Duration("scan-channel-time", 0, "how long to camp on each channel while scanning, defaults to a full cycle of the hop pattern")
 	verbose = flag.Bool("v", false, "log extra information to /dev/stderr")
 
 	flag.Parse()
 
+	if len(ids) == 0 {
+		ids = idList{0}
+	}
+
+	// Readings other transmitters carry, such as the calm wind reported by
+	// those without an anemometer, would overwrite the ISS's.
+	if *issID < 0 {
+		*issID = ids[0]
+	}
+	if *windID < 0 {
+		*windID = *issID
+	}
+
+	// Repeaters can only be given for the ids listened for, which may be
+	// set after them.
+	for id, repeater := range repeaters {
+		if !ids.contains(id) {
+			fmt.Fprintf(os.Stderr, "invalid value \"%d=%s\" for flag -repeater: not listening for id %d, see -id\n", id, repeater, id)
+			flag.Usage()
+			os.Exit(2)
+		}
+	}
+
 	verboseLogger = log.New(ioutil.Discard, "", log.Lshortfile|log.Lmicroseconds)
 	if *verbose {
 		verboseLogger.SetOutput(os.Stderr)
@@ -54,124 +239,264 @@ func init() {
 }
 
 func main() {
-	p := protocol.NewParser(14, *id)
-	p.Cfg.Log()
-
-	fs := p.Cfg.SampleRate
-
-	dev, err := rtlsdr.Open(0)
+	b, err := protocol.LookupBand(*band)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	hop := p.RandHop()
-	verboseLogger.Println(hop)
-	if err := dev.SetCenterFreq(hop.ChannelFreq); err != nil {
+	wind := weather.Wind{Offset: *windOffset}
+	if wind.Encoding, err = weather.ParseWindEncoding(*windEncoding); err != nil {
 		log.Fatal(err)
 	}
 
-	if err := dev.SetSampleRate(fs); err != nil {
+	stdout, err := output.New(*format, os.Stdout, wind)
+	if err != nil {
 		log.Fatal(err)
 	}
+	sink := output.Multi{stdout, output.NewAlerts(log.New(os.Stderr, "", log.Lmicroseconds), *superCapLow)}
+
+	if *mqttAddr != "" {
+		opts := mqtt.DefaultOptions(*mqttAddr)
+		opts.Username = *mqttUser
+		// The password isn't a flag so it isn't visible in the process
+		// list.
+		opts.Password = os.Getenv("RTLDAVIS_MQTT_PASSWORD")
+		if *mqttPassFile != "" {
+			buf, err := ioutil.ReadFile(*mqttPassFile)
+			if err != nil {
+				log.Fatal(err)
+			}
+			opts.Password = strings.TrimRight(string(buf), "\r\n")
+		}
+		opts.Logger = log.New(os.Stderr, "", log.Lmicroseconds)
+
+		client := mqtt.NewClient(opts)
+		defer client.Close()
+
+		publisher := mqtt.NewPublisher(client, *mqttPrefix, *mqttRetain, *mqttDiscovery)
+		publisher.Wind = wind
+		sink = append(sink, publisher)
+	}
 
-	if err := dev.SetTunerGainMode(false); err != nil {
-		log.Fatal(err)
+	if *influxURL != "" {
+		opts := influx.DefaultOptions(*influxURL)
+		opts.Token = *influxToken
+		opts.Wind = wind
+		opts.Logger = log.New(os.Stderr, "", log.Lmicroseconds)
+
+		client := influx.NewClient(opts)
+		defer client.Close()
+
+		sink = append(sink, client)
 	}
 
-	if err := dev.ResetBuffer(); err != nil {
+	conditions := weather.NewConditions(*issID, *windID)
+	conditions.Wind = wind
+	if conditions.Rain.Bucket, err = weather.ParseBucket(*rainBucket); err != nil {
 		log.Fatal(err)
 	}
 
-	in, out := io.Pipe()
+	if *rainFile != "" {
+		rain, err := weather.LoadRain(*rainFile)
+		switch {
+		case err == nil:
+			// The configured bucket applies to rain from now on.
+			rain.Bucket = conditions.Rain.Bucket
+			conditions.Rain = rain
+		case !os.IsNotExist(err):
+			log.Println(err)
+		}
+	}
 
-	go dev.ReadAsync(func(buf []byte) {
-		out.Write(buf)
-	}, nil, 1, p.Cfg.BlockSize2)
+	// Derived values, wind averages, ET and rain totals are maintained for
+	// whichever sinks consume them.
+	var consumers []weather.Sink
 
-	// Handle frequency hops concurrently since the callback will stall if we
-	// stop reading to hop.
-	nextHop := make(chan protocol.Hop, 1)
-	go func() {
-		for hop := range nextHop {
-			verboseLogger.Printf("Hop: %s\n", hop)
-			if err := dev.SetCenterFreq(hop.ChannelFreq + hop.FreqError); err != nil {
+	if *vantageAddr != "" {
+		console := vantage.NewServer(conditions)
+		go func() {
+			log.Fatal(console.ListenAndServe(*vantageAddr))
+		}()
+
+		consumers = append(consumers, console)
+	}
+
+	if *condFile != "" {
+		w := os.Stdout
+		if *condFile != "-" {
+			f, err := os.Create(*condFile)
+			if err != nil {
 				log.Fatal(err)
 			}
+			defer f.Close()
+			w = f
 		}
-	}()
 
-	defer func() {
-		in.Close()
-		out.Close()
-		dev.CancelAsync()
-		dev.Close()
-		os.Exit(0)
-	}()
+		consumers = append(consumers, output.NewConditionsJSON(w))
+	}
 
-	sig := make(chan os.Signal, 1)
-	signal.Notify(sig, os.Interrupt, os.Kill)
+	var (
+		metricsSink *metrics.Metrics
+		apiServer   *api.Server
+	)
+	if *httpAddr != "" {
+		metricsSink = metrics.New(nil)
+		metricsSink.Wind = wind
+		apiServer = api.NewServer(nil)
+		apiServer.Wind = wind
+		sink = append(sink, metricsSink, apiServer)
+	}
 
-	block := make([]byte, p.Cfg.BlockSize2)
-
-	// Set the dwellTimer for one full rotation of the pattern + 1. Some channels
-	// may have enough frequency error that they won't receive until we've
-	// seen at least one message and set the frequency correction.
-	dwellTimer := time.After(52 * p.DwellTime)
-	// We set missCount to 3 so that we immediately pick another random
-	// channel and wait on that channel instead of hopping like we missed one.
-	missCount := 3
-
-	for {
-		select {
-		case <-sig:
-			return
-		case <-dwellTimer:
-			// If the dwellTimer has expired one of two things has happened:
-			//     1: We've missed a message.
-			//     2: We've waited for sync and nothing has happened for a
-			//        full cycle of the pattern.
-
-			// Reset the timer and incrmeent the missed packet counter.
-			dwellTimer = time.After(p.DwellTime)
-			missCount++
-
-			if missCount >= 3 {
-				// We've missed three packets in a row, hop to a random
-				// channel and wait for a full hopping cycle.
-				nextHop <- p.RandHop()
-				dwellTimer = time.After(52 * p.DwellTime)
-			} else {
-				// We've missed fewer than three packets in a row, hop to the
-				// next channel in the pattern.
-				nextHop <- p.NextHop()
+	for _, s := range sink {
+		if c, ok := s.(weather.Sink); ok {
+			consumers = append(consumers, c)
+		}
+	}
+	if *rainFile != "" && len(consumers) == 0 {
+		log.Fatal("-rain needs an output reporting rain totals: -vantage, -conditions, -mqtt, -influx, -http, or -format influx")
+	}
+	if len(consumers) > 0 {
+		station := weather.NewStation(conditions, consumers...)
+		sink = append(sink, station)
+
+		if *rainFile != "" {
+			saveRain := func() {
+				if err := station.Conditions().Rain.Save(*rainFile); err != nil {
+					log.Println(err)
+				}
 			}
-		default:
-			in.Read(block)
+			defer saveRain()
 
-			recvPacket := false
-			for _, msg := range p.Parse(p.Demodulate(block)) {
-				if int(msg.ID) != *id {
-					continue
+			go func() {
+				for range time.Tick(*stateInterval) {
+					saveRain()
 				}
+			}()
+		}
+	}
 
-				recvPacket = true
-				log.Printf("%02X\n", msg.Data)
-			}
+	cfg := protocol.NewPacketConfig(receiver.SymbolLength)
+	fs := cfg.SampleRate
+
+	// Sources are opened on the first channel of the band, the receiver
+	// retunes to the first hop before it starts reading.
+	centerFreq := b.Channels[0] + protocol.TuningOffset
 
-			if recvPacket {
-				// Reset the missed packet counter.
-				missCount = 0
+	opts := []receiver.Option{
+		receiver.WithIDs(ids...),
+		receiver.WithBand(b),
+		receiver.WithSinks(sink),
+		receiver.WithLogger(log.New(os.Stderr, "", log.Lmicroseconds)),
+		receiver.WithVerboseLogger(verboseLogger),
+	}
+	for id, repeater := range repeaters {
+		opts = append(opts, receiver.WithRepeater(id, repeater))
+	}
+	if *stateFile != "" {
+		opts = append(opts, receiver.WithState(*stateFile, *stateInterval))
+	}
+	if *statsInterval > 0 {
+		opts = append(opts, receiver.WithStatsLog(*statsInterval))
+	}
 
-				// Set the dwell timer to 1.5 * dwell time. If this timer
-				// expires before we've received a packet then the missed
-				// packet hopping logic will reset the timer to exactly the
-				// dwell time and we then expect packets to arrive half-way
-				// through the timer.
-				dwellTimer = time.After(p.DwellTime + p.DwellTime>>1)
+	var src source.Source
+	switch {
+	case *input != "":
+		// When replaying a recording the samples are the only clock we
+		// have, so time is measured by the number of samples read from the
+		// start of the recording.
+		opts = append(opts, receiver.WithSampleClock(time.Unix(0, 0).UTC()))
+		src, err = source.Open(*input)
+	case *tcpAddr != "":
+		src, err = source.DialRTLTCP(*tcpAddr, centerFreq, fs)
+	default:
+		src, err = openRTLSDR(0, centerFreq, fs, cfg.BlockSize2)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
 
-				// Hop to the next channel.
-				nextHop <- p.NextHop()
-			}
+	if *record != "" {
+		src, err = source.Create(src, *record, fs, centerFreq)
+		if err != nil {
+			log.Fatal(err)
 		}
 	}
+	defer src.Close()
+
+	r, err := receiver.New(append(opts, receiver.WithSource(src))...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	r.Config().Log()
+	log.Println("Band:", r.Band())
+
+	if *httpAddr != "" {
+		metricsSink.Stats = r.Stats
+		apiServer.Stats = r.Stats
+
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metricsSink)
+		mux.Handle("/api/", apiServer)
+		go func() {
+			log.Fatal(http.ListenAndServe(*httpAddr, mux))
+		}()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, os.Kill)
+	go func() {
+		<-sig
+		cancel()
+	}()
+
+	if *scan > 0 {
+		channelTime := *scanChannelTime
+		if channelTime <= 0 {
+			channelTime = b.SyncWait(protocol.MaxTransmitters - 1)
+		}
+
+		stations, err := r.Scan(ctx, channelTime, *scan)
+		if err != nil && err != context.Canceled {
+			log.Println(err)
+		}
+		printStations(os.Stdout, stations)
+		return
+	}
+
+	if err := r.Run(ctx); err != nil && err != context.Canceled {
+		log.Println(err)
+	}
+}
+
+// printStations writes a table of the stations heard while scanning.
+func printStations(w io.Writer, stations []receiver.Station) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tVia\tPackets\tPeriod\tFreqError\tRSSI\tSNR\tSensors")
+
+	for _, s := range stations {
+		period := "-"
+		if s.Period > 0 {
+			period = s.Period.String()
+		}
+
+		sensors := make([]string, len(s.Sensors))
+		for idx, sensor := range s.Sensors {
+			sensors[idx] = sensor.Key()
+		}
+
+		via := "-"
+		if s.Repeater != protocol.NoRepeater {
+			via = s.Repeater.String()
+		}
+
+		fmt.Fprintf(tw, "%d\t%s\t%d\t%s\t%d Hz\t%0.1f dBFS\t%0.1f dB\t%s\n",
+			s.ID, via, s.Packets, period, s.FreqError, s.RSSI, s.SNR, strings.Join(sensors, ","),
+		)
+	}
+
+	tw.Flush()
 }
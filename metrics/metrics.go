@@ -0,0 +1,245 @@
+/*
+   rtldavis, an rtl-sdr receiver for Davis Instruments weather stations.
+   Copyright (C) 2015  Douglas Hall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+// Package metrics exposes reception statistics and the latest readings in the
+// Prometheus text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bemasher/rtldavis/protocol"
+	"github.com/bemasher/rtldavis/receiver"
+	"github.com/bemasher/rtldavis/weather"
+)
+
+// latest is the most recent message heard from a transmitter.
+type latest struct {
+	time          time.Time
+	rssi, snr     float64
+	freqError     int
+	batteryLow    bool
+	windSpeed     float64
+	windDirection float64
+
+	// Valid readings keyed by sensor.
+	values map[protocol.Sensor]float64
+}
+
+// Metrics is a sink remembering the latest readings of each transmitter and
+// an http.Handler serving them along with the receiver's statistics.
+type Metrics struct {
+	// Stats returns the statistics to expose, if set.
+	Stats func() receiver.Stats
+
+	// Wind decodes the wind direction of each message to degrees.
+	Wind weather.Wind
+
+	mu         sync.Mutex
+	latest     map[int]*latest
+	conditions []weather.Value
+}
+
+func New(stats func() receiver.Stats) *Metrics {
+	return &Metrics{
+		Stats:  stats,
+		latest: make(map[int]*latest),
+	}
+}
+
+func (m *Metrics) Write(msg protocol.Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	l, ok := m.latest[int(msg.ID)]
+	if !ok {
+		l = &latest{values: make(map[protocol.Sensor]float64)}
+		m.latest[int(msg.ID)] = l
+	}
+
+	l.time = msg.Time
+	l.rssi = msg.RSSI
+	l.snr = msg.SNR
+	l.freqError = msg.FreqError
+	l.batteryLow = msg.BatteryLow
+	l.windSpeed = float64(msg.WindSpeed)
+	l.windDirection = m.Wind.Direction(msg.WindDirection)
+	if msg.Valid {
+		l.values[msg.Sensor] = msg.Value
+	}
+
+	return nil
+}
+
+// WriteConditions remembers the latest derived values, wind averages, ET and
+// rain totals.
+func (m *Metrics) WriteConditions(c weather.Conditions) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.conditions = c.Values()
+	return nil
+}
+
+// writer writes metrics in the text exposition format.
+type writer struct {
+	*bufio.Writer
+}
+
+// family writes the help and type of a metric.
+func (w writer) family(name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// sample writes a single sample, labels are given as name, value pairs.
+func (w writer) sample(name string, value float64, labels ...string) {
+	w.WriteString(name)
+	if len(labels) > 0 {
+		pairs := make([]string, 0, len(labels)/2)
+		for idx := 0; idx+1 < len(labels); idx += 2 {
+			pairs = append(pairs, labels[idx]+`="`+labelEscaper.Replace(labels[idx+1])+`"`)
+		}
+		w.WriteString("{" + strings.Join(pairs, ",") + "}")
+	}
+	w.WriteString(" " + strconv.FormatFloat(value, 'g', -1, 64) + "\n")
+}
+
+// counts describes a metric taken from reception counts.
+type counts struct {
+	name, kind, help string
+	value            func(receiver.Counts) float64
+}
+
+var transmitterCounts = []counts{
+	{"rtldavis_packets_received_total", "counter", "Packets received.", func(c receiver.Counts) float64 { return float64(c.Received) }},
+	{"rtldavis_packets_missed_total", "counter", "Dwell slots a packet was expected in but not received.", func(c receiver.Counts) float64 { return float64(c.Missed) }},
+	{"rtldavis_crc_errors_total", "counter", "Packets failing their CRC.", func(c receiver.Counts) float64 { return float64(c.CRCErrors) }},
+	{"rtldavis_duplicates_total", "counter", "Packets received more than once.", func(c receiver.Counts) float64 { return float64(c.Duplicates) }},
+	{"rtldavis_resyncs_total", "counter", "Times synchronization with the hop pattern was gained.", func(c receiver.Counts) float64 { return float64(c.Resyncs) }},
+	{"rtldavis_sync_lost_total", "counter", "Times synchronization with the hop pattern was lost.", func(c receiver.Counts) float64 { return float64(c.SyncLost) }},
+	{"rtldavis_reception_ratio", "gauge", "Fraction of expected packets received.", func(c receiver.Counts) float64 { return c.Reception() / 100 }},
+}
+
+var channelCounts = []counts{
+	{"rtldavis_channel_packets_received_total", "counter", "Packets received by channel.", func(c receiver.Counts) float64 { return float64(c.Received) }},
+	{"rtldavis_channel_packets_missed_total", "counter", "Packets missed by channel.", func(c receiver.Counts) float64 { return float64(c.Missed) }},
+	{"rtldavis_channel_crc_errors_total", "counter", "Packets failing their CRC by channel.", func(c receiver.Counts) float64 { return float64(c.CRCErrors) }},
+	{"rtldavis_channel_freq_error_hertz", "gauge", "Mean frequency error of packets received by channel.", func(c receiver.Counts) float64 { return c.FreqError }},
+}
+
+// sortedKeys returns the keys of a map of counts in ascending order.
+func sortedKeys(m map[int]receiver.Counts) []int {
+	keys := make([]int, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Ints(keys)
+	return keys
+}
+
+func (m *Metrics) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	w := writer{bufio.NewWriter(rw)}
+	defer w.Flush()
+
+	if m.Stats != nil {
+		stats := m.Stats()
+
+		for _, c := range transmitterCounts {
+			w.family(c.name, c.kind, c.help)
+			for _, id := range sortedKeys(stats.Transmitters) {
+				w.sample(c.name, c.value(stats.Transmitters[id]), "id", strconv.Itoa(id))
+			}
+		}
+
+		for _, c := range channelCounts {
+			w.family(c.name, c.kind, c.help)
+			for _, channel := range sortedKeys(stats.Channels) {
+				w.sample(c.name, c.value(stats.Channels[channel]), "channel", strconv.Itoa(channel))
+			}
+		}
+
+		w.family("rtldavis_hops_total", "counter", "Times the receiver was retuned.")
+		w.sample("rtldavis_hops_total", float64(stats.Hops))
+
+		w.family("rtldavis_sample_overruns_total", "counter", "Times samples were dropped because they weren't read in time.")
+		w.sample("rtldavis_sample_overruns_total", float64(stats.Overruns))
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ids := make([]int, 0, len(m.latest))
+	for id := range m.latest {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	gauges := []struct {
+		name, help string
+		value      func(*latest) float64
+	}{
+		{"rtldavis_last_message_timestamp_seconds", "Time the last message was received.", func(l *latest) float64 { return float64(l.time.UnixNano()) / 1e9 }},
+		{"rtldavis_rssi_dbfs", "Signal strength of the last message.", func(l *latest) float64 { return l.rssi }},
+		{"rtldavis_snr_db", "Signal to noise ratio of the last message.", func(l *latest) float64 { return l.snr }},
+		{"rtldavis_freq_error_hertz", "Frequency error of the last message.", func(l *latest) float64 { return float64(l.freqError) }},
+		{"rtldavis_battery_low", "Whether the last message reported a low battery.", func(l *latest) float64 {
+			if l.batteryLow {
+				return 1
+			}
+			return 0
+		}},
+	}
+	for _, g := range gauges {
+		w.family(g.name, "gauge", g.help)
+		for _, id := range ids {
+			w.sample(g.name, g.value(m.latest[id]), "id", strconv.Itoa(id))
+		}
+	}
+
+	w.family("rtldavis_sensor_value", "gauge", "Latest valid reading of each sensor.")
+	for _, id := range ids {
+		l := m.latest[id]
+		w.sample("rtldavis_sensor_value", l.windSpeed, "id", strconv.Itoa(id), "sensor", "wind_speed", "unit", "mph")
+		w.sample("rtldavis_sensor_value", l.windDirection, "id", strconv.Itoa(id), "sensor", "wind_direction", "unit", "°")
+
+		sensors := make([]protocol.Sensor, 0, len(l.values))
+		for sensor := range l.values {
+			sensors = append(sensors, sensor)
+		}
+		sort.Slice(sensors, func(i, j int) bool { return sensors[i] < sensors[j] })
+
+		for _, sensor := range sensors {
+			w.sample("rtldavis_sensor_value", l.values[sensor], "id", strconv.Itoa(id), "sensor", sensor.Key(), "unit", sensor.Unit())
+		}
+	}
+
+	w.family("rtldavis_conditions_value", "gauge", "Latest derived value, wind average, ET and rain total.")
+	for _, v := range m.conditions {
+		w.sample("rtldavis_conditions_value", v.Value, "sensor", v.Key, "unit", v.Unit)
+	}
+}
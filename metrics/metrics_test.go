@@ -0,0 +1,96 @@
+package metrics
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bemasher/rtldavis/dsp"
+	"github.com/bemasher/rtldavis/protocol"
+	"github.com/bemasher/rtldavis/receiver"
+	"github.com/bemasher/rtldavis/weather"
+)
+
+func scrape(t *testing.T, m *Metrics) string {
+	srv := httptest.NewServer(m)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Fatalf("bad content type: %q\n", ct)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestMetrics(t *testing.T) {
+	stats := receiver.Stats{
+		Transmitters: map[int]receiver.Counts{0: {Received: 9, Missed: 1, CRCErrors: 2}},
+		Channels:     map[int]receiver.Counts{12: {Received: 9, FreqError: -1234}},
+		Hops:         10,
+		Overruns:     3,
+	}
+	m := New(func() receiver.Stats { return stats })
+	m.Wind.Encoding = weather.Vue
+
+	// Temperature of 72.5°F, 5mph wind.
+	msg := protocol.NewMessage(dsp.Packet{Data: []byte{0xCB, 0x89, 0x80, 0x05, 0x4A, 0x2D, 0x50, 0x00, 0x12, 0x34}})
+	msg.Time = time.Unix(1500000000, 0)
+	msg.RSSI = -20.5
+	m.Write(msg)
+
+	// UV index of 1.14.
+	msg = protocol.NewMessage(dsp.Packet{Data: []byte{0xCB, 0x89, 0x40, 0x05, 0x4A, 0x0E, 0x40, 0x00, 0x12, 0x34}})
+	msg.Time = time.Unix(1500000002, 500000000)
+	m.Write(msg)
+
+	body := scrape(t, m)
+
+	for _, line := range []string{
+		`rtldavis_packets_received_total{id="0"} 9`,
+		`rtldavis_packets_missed_total{id="0"} 1`,
+		`rtldavis_crc_errors_total{id="0"} 2`,
+		`rtldavis_reception_ratio{id="0"} 0.9`,
+		`rtldavis_channel_freq_error_hertz{channel="12"} -1234`,
+		`rtldavis_hops_total 10`,
+		`rtldavis_sample_overruns_total 3`,
+		`rtldavis_sensor_value{id="0",sensor="temperature",unit="°F"} 72.5`,
+		`rtldavis_sensor_value{id="0",sensor="wind_speed",unit="mph"} 5`,
+		`rtldavis_sensor_value{id="0",sensor="wind_direction",unit="°"} 104.3625`,
+		`rtldavis_sensor_value{id="0",sensor="uv_index",unit="index"} 1.14`,
+		`rtldavis_last_message_timestamp_seconds{id="0"} 1.5000000025e+09`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Fatalf("missing %q in:\n%s\n", line, body)
+		}
+	}
+
+	// Every sample belongs to a declared family.
+	declared := make(map[string]bool)
+	for _, line := range strings.Split(strings.TrimSpace(body), "\n") {
+		if strings.HasPrefix(line, "# TYPE ") {
+			declared[strings.Fields(line)[2]] = true
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		name := strings.FieldsFunc(line, func(r rune) bool { return r == '{' || r == ' ' })[0]
+		if !declared[name] {
+			t.Fatalf("sample of undeclared metric: %q\n", line)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+/*
+   rtldavis, an rtl-sdr receiver for Davis Instruments weather stations.
+   Copyright (C) 2015  Douglas Hall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+// Package modulator synthesizes the signal a Davis transmitter produces as
+// it would be received by an rtl-sdr dongle, for testing the demodulator
+// and parser without hardware.
+package modulator
+
+import (
+	"encoding/binary"
+	"math"
+	"math/rand"
+
+	"github.com/bemasher/rtldavis/crc"
+	"github.com/bemasher/rtldavis/dsp"
+	"github.com/bemasher/rtldavis/protocol"
+)
+
+// Sync is the sync word preceding each packet, as received over the air.
+var Sync = []byte{0xCB, 0x89}
+
+var ccitt = crc.NewCRC("CCITT-16", 0, 0x1021, 0)
+
+// Frame builds a packet from message data as sent by its transmitter: the
+// sync word followed by the data, its CRC and the trailer, each byte
+// bit-reversed for transmission.
+func Frame(data []byte) []byte {
+	return RepeatedFrame(data, protocol.NoRepeater)
+}
+
+// RepeatedFrame builds a packet from message data as retransmitted by a
+// repeater.
+func RepeatedFrame(data []byte, repeater protocol.Repeater) []byte {
+	payload := make([]byte, len(data)+2)
+	copy(payload, data)
+	binary.BigEndian.PutUint16(payload[len(data):], ccitt.Checksum(data))
+	payload = append(payload, protocol.EncodeRepeater(repeater)...)
+
+	frame := append([]byte{}, Sync...)
+	for _, b := range payload {
+		frame = append(frame, protocol.SwapBitOrder(b))
+	}
+
+	return frame
+}
+
+// Bits expands a frame to one bit per byte, most significant bit first,
+// preceded by an alternating preamble and followed by a short tail. The
+// tail continues the trailer's ones as a transmitter does, the parser
+// estimates frequency error from the symbols either side of the end of the
+// trailer.
+func Bits(frame []byte) (bits []byte) {
+	for idx := 0; idx < 32; idx++ {
+		bits = append(bits, byte(^idx&1))
+	}
+
+	for _, b := range frame {
+		for bit := 7; bit >= 0; bit-- {
+			bits = append(bits, (b>>uint(bit))&1)
+		}
+	}
+
+	for idx := 0; idx < 8; idx++ {
+		bits = append(bits, 1)
+	}
+
+	return bits
+}
+
+// Modulator synthesizes 8-bit interleaved IQ samples of a GFSK signal.
+type Modulator struct {
+	SampleRate int
+	BitRate    int
+
+	// Deviation is the frequency offset of each symbol from the carrier in
+	// Hz. Ones are above the carrier, zeros below.
+	Deviation float64
+
+	// BT is the bandwidth-time product of the Gaussian pulse shaping filter.
+	BT float64
+
+	// Offset is the carrier frequency relative to the center of the samples
+	// in Hz. The demodulator's channel filter passes signals a quarter of the
+	// sample rate below center.
+	Offset float64
+
+	// Amplitude of the signal and standard deviation of the noise added to
+	// each of I and Q, relative to full scale.
+	Amplitude float64
+	Noise     float64
+
+	// Jitter is the standard deviation of each symbol's timing error as a
+	// fraction of the symbol length.
+	Jitter float64
+
+	Rand *rand.Rand
+
+	phase float64
+}
+
+// New returns a modulator for the given packet configuration with a clean,
+// on-frequency signal.
+func New(cfg dsp.PacketConfig) *Modulator {
+	return &Modulator{
+		SampleRate: cfg.SampleRate,
+		BitRate:    cfg.BitRate,
+		Deviation:  9600,
+		BT:         0.5,
+		Offset:     -float64(cfg.SampleRate) / 4,
+		Amplitude:  0.5,
+		Rand:       rand.New(rand.NewSource(1)),
+	}
+}
+
+// Modulate returns the samples of the given bits.
+func (m *Modulator) Modulate(bits []byte) []byte {
+	samplesPerSymbol := float64(m.SampleRate) / float64(m.BitRate)
+
+	// Each symbol boundary is displaced by a random timing error.
+	bounds := make([]float64, len(bits)+1)
+	for idx := range bounds {
+		bounds[idx] = float64(idx) * samplesPerSymbol
+		if idx > 0 && idx < len(bits) {
+			bounds[idx] += m.Rand.NormFloat64() * m.Jitter * samplesPerSymbol
+		}
+	}
+
+	n := int(bounds[len(bits)])
+	symbols := make([]float64, n)
+	sym := 0
+	for idx := range symbols {
+		for sym < len(bits)-1 && float64(idx) >= bounds[sym+1] {
+			sym++
+		}
+		symbols[idx] = float64(bits[sym])*2 - 1
+	}
+
+	shaped := gaussian(symbols, m.BT, samplesPerSymbol)
+
+	samples := make([]byte, n<<1)
+	for idx, s := range shaped {
+		freq := m.Offset + s*m.Deviation
+		m.phase = math.Mod(m.phase+2*math.Pi*freq/float64(m.SampleRate), 2*math.Pi)
+
+		i := m.Amplitude * math.Cos(m.phase)
+		q := m.Amplitude * math.Sin(m.phase)
+		samples[idx<<1] = m.quantize(i)
+		samples[idx<<1+1] = m.quantize(q)
+	}
+
+	return samples
+}
+
+// Silence returns n samples of noise.
+func (m *Modulator) Silence(n int) []byte {
+	samples := make([]byte, n<<1)
+	for idx := range samples {
+		samples[idx] = m.quantize(0)
+	}
+	return samples
+}
+
+// Packet returns the samples of a complete packet carrying data.
+func (m *Modulator) Packet(data []byte) []byte {
+	return m.Modulate(Bits(Frame(data)))
+}
+
+// RepeatedPacket returns the samples of a packet carrying data retransmitted
+// by a repeater.
+func (m *Modulator) RepeatedPacket(data []byte, repeater protocol.Repeater) []byte {
+	return m.Modulate(Bits(RepeatedFrame(data, repeater)))
+}
+
+// quantize adds noise to a sample and converts it to the unsigned 8-bit
+// format of an rtl-sdr, the inverse of dsp.ByteToCmplxLUT.
+func (m *Modulator) quantize(x float64) byte {
+	if m.Noise > 0 {
+		x += m.Rand.NormFloat64() * m.Noise
+	}
+
+	v := math.Floor(x*127.6 + 127.4 + 0.5)
+	if v < 0 {
+		return 0
+	}
+	if v > 255 {
+		return 255
+	}
+	return byte(v)
+}
+
+// gaussian filters a signal with a unit-gain Gaussian pulse shaping filter
+// with the given bandwidth-time product.
+func gaussian(in []float64, bt, samplesPerSymbol float64) []float64 {
+	// Standard deviation of the Gaussian impulse response in samples.
+	sigma := math.Sqrt(math.Log(2)) / (2 * math.Pi * bt) * samplesPerSymbol
+
+	half := int(math.Ceil(3 * sigma))
+	taps := make([]float64, 2*half+1)
+	var sum float64
+	for idx := range taps {
+		t := float64(idx - half)
+		taps[idx] = math.Exp(-t * t / (2 * sigma * sigma))
+		sum += taps[idx]
+	}
+
+	out := make([]float64, len(in))
+	for idx := range out {
+		var acc float64
+		for tIdx, tap := range taps {
+			inIdx := idx + tIdx - half
+			if inIdx < 0 {
+				inIdx = 0
+			}
+			if inIdx >= len(in) {
+				inIdx = len(in) - 1
+			}
+			acc += tap * in[inIdx]
+		}
+		out[idx] = acc / sum
+	}
+
+	return out
+}
@@ -0,0 +1,223 @@
+package modulator
+
+import (
+	"bytes"
+	"math"
+	"testing"
+
+	"github.com/bemasher/rtldavis/protocol"
+)
+
+// Temperature of 72.5°F from transmitter 0 with 5mph wind at 74.
+var temperature = []byte{0x80, 0x05, 0x4A, 0x2D, 0x50, 0x00}
+
+// decode feeds samples through the demodulator and parser a block at a time
+// and returns every message decoded.
+func decode(samples []byte) (msgs []protocol.Message) {
+	p := protocol.NewParser(14, protocol.US, 0)
+
+	block := make([]byte, p.Cfg.BlockSize2)
+	for len(samples) > 0 {
+		n := copy(block, samples)
+		for idx := n; idx < len(block); idx++ {
+			block[idx] = 127
+		}
+		samples = samples[n:]
+
+		msgs = append(msgs, p.Parse(p.Demodulate(block))...)
+	}
+
+	return msgs
+}
+
+func TestFrame(t *testing.T) {
+	frame := Frame(temperature)
+	if len(frame) != 12 {
+		t.Fatalf("expected 12 byte frame, got %d\n", len(frame))
+	}
+
+	// Undo what the parser does and check the CRC, which doesn't cover the
+	// trailer.
+	data := make([]byte, len(frame)-2)
+	for idx, b := range frame[2:] {
+		data[idx] = protocol.SwapBitOrder(b)
+	}
+	if ccitt.Checksum(data[:protocol.PayloadLength]) != 0 {
+		t.Fatalf("bad CRC: %02X\n", data)
+	}
+	if trailer := data[protocol.PayloadLength:]; trailer[0] != 0xFF || trailer[1] != 0xFF {
+		t.Fatalf("expected trailer FFFF, got %02X\n", trailer)
+	}
+}
+
+func TestRepeated(t *testing.T) {
+	p := protocol.NewParser(14, protocol.US, 0)
+	m := New(p.Cfg)
+
+	var samples []byte
+	samples = append(samples, m.Silence(3000)...)
+	samples = append(samples, m.Packet(temperature)...)
+	samples = append(samples, m.Silence(3000)...)
+	samples = append(samples, m.RepeatedPacket(temperature, protocol.RepeaterC)...)
+	samples = append(samples, m.Silence(3000)...)
+
+	msgs := decode(samples)
+	if len(msgs) != 2 {
+		t.Fatalf("expected 2 messages, got %d\n", len(msgs))
+	}
+	if msgs[0].Repeater != protocol.NoRepeater || msgs[1].Repeater != protocol.RepeaterC {
+		t.Fatalf("expected direct then repeater C, got %q and %q\n", msgs[0].Repeater, msgs[1].Repeater)
+	}
+	if !bytes.Equal(msgs[0].Data, msgs[1].Data) || len(msgs[1].Data) != protocol.PayloadLength {
+		t.Fatalf("expected the same payload, got %02X and %02X\n", msgs[0].Data, msgs[1].Data)
+	}
+}
+
+func TestEndToEnd(t *testing.T) {
+	p := protocol.NewParser(14, protocol.US, 0)
+	center := -float64(p.Cfg.SampleRate) / 4
+
+	tests := []struct {
+		Name   string
+		Offset float64
+		Noise  float64
+		Jitter float64
+	}{
+		{"clean", 0, 0, 0},
+		{"noise", 0, 0.05, 0},
+		{"high", 5000, 0.02, 0},
+		{"low", -5000, 0.02, 0},
+		{"jitter", 0, 0.02, 0.05},
+	}
+
+	for _, test := range tests {
+		m := New(p.Cfg)
+		m.Offset = center + test.Offset
+		m.Noise = test.Noise
+		m.Jitter = test.Jitter
+
+		var samples []byte
+		samples = append(samples, m.Silence(3000)...)
+		samples = append(samples, m.Packet(temperature)...)
+		samples = append(samples, m.Silence(3000)...)
+
+		msgs := decode(samples)
+		if len(msgs) != 1 {
+			t.Errorf("%s: expected 1 message, got %d\n", test.Name, len(msgs))
+			continue
+		}
+
+		msg := msgs[0]
+		if !bytes.Equal(msg.Data[:6], temperature) {
+			t.Errorf("%s: expected data %02X, got %02X\n", test.Name, temperature, msg.Data[:6])
+		}
+		if msg.Sensor != protocol.Temperature || !msg.Valid || msg.Value != 72.5 {
+			t.Errorf("%s: bad decode: %s\n", test.Name, msg)
+		}
+
+		// The transmitter is above the channel by the offset, which the
+		// receiver should be retuned by.
+		if math.Abs(float64(msg.FreqError)-test.Offset) > 500 {
+			t.Errorf("%s: expected frequency error near %0.0fHz, got %d\n", test.Name, test.Offset, msg.FreqError)
+		}
+
+		// The packet's amplitude is 0.5 of full scale.
+		if math.Abs(msg.RSSI+6) > 1 {
+			t.Errorf("%s: expected RSSI near -6dBFS, got %0.1f\n", test.Name, msg.RSSI)
+		}
+
+		// The channel filter passes about a sixth of the noise power.
+		snr := 60.0
+		if test.Noise > 0 {
+			snr = 10 * math.Log10(0.25/(2*test.Noise*test.Noise*0.165))
+		}
+		if msg.SNR < snr-1.5 || (test.Noise > 0 && msg.SNR > snr+1.5) {
+			t.Errorf("%s: expected SNR near %0.1fdB, got %0.1f\n", test.Name, snr, msg.SNR)
+		}
+	}
+}
+
+func TestBands(t *testing.T) {
+	for _, b := range protocol.Bands {
+		p := protocol.NewParser(14, b, 0)
+
+		for _, channel := range []int{0, len(b.Channels) - 1} {
+			// Tune to the channel and transmit on its frequency.
+			hop := protocol.Hop{ChannelIdx: channel, ChannelFreq: b.Channels[channel]}
+			center := p.CenterFreq(hop)
+
+			m := New(p.Cfg)
+			m.Offset = float64(b.Channels[channel] - center)
+
+			var samples []byte
+			samples = append(samples, m.Silence(3000)...)
+			samples = append(samples, m.Packet(temperature)...)
+			samples = append(samples, m.Silence(3000)...)
+
+			msgs := decode(samples)
+			if len(msgs) != 1 || !bytes.Equal(msgs[0].Data[:6], temperature) {
+				t.Errorf("%s: channel %d: expected 1 message, got %d\n", b, channel, len(msgs))
+				continue
+			}
+
+			// Retuning by the frequency error should put the transmitter
+			// where the demodulator expects it.
+			hop.FreqError = msgs[0].FreqError
+			offset := float64(b.Channels[channel] - p.CenterFreq(hop))
+			if expected := -float64(p.Cfg.SampleRate) / 4; math.Abs(offset-expected) > 500 {
+				t.Errorf("%s: channel %d: expected retuned offset near %0.0fHz, got %0.0f\n", b, channel, expected, offset)
+			}
+
+			// Neighbouring channels must not be received.
+			for _, neighbour := range []int{channel - 1, channel + 1} {
+				if neighbour < 0 || neighbour >= len(b.Channels) {
+					continue
+				}
+				m.Offset = float64(b.Channels[neighbour] - center)
+
+				samples = samples[:0]
+				samples = append(samples, m.Silence(3000)...)
+				samples = append(samples, m.Packet(temperature)...)
+				samples = append(samples, m.Silence(3000)...)
+
+				if msgs := decode(samples); len(msgs) != 0 {
+					t.Errorf("%s: channel %d: received channel %d\n", b, channel, neighbour)
+				}
+			}
+		}
+	}
+}
+
+func TestNoise(t *testing.T) {
+	p := protocol.NewParser(14, protocol.US, 0)
+
+	m := New(p.Cfg)
+	m.Noise = 0.3
+
+	if msgs := decode(m.Silence(1 << 16)); len(msgs) != 0 {
+		t.Fatalf("decoded %d messages from noise\n", len(msgs))
+	}
+}
+
+func TestMultiplePackets(t *testing.T) {
+	p := protocol.NewParser(14, protocol.US, 0)
+	m := New(p.Cfg)
+	m.Noise = 0.02
+
+	humidity := []byte{0xA0, 0x05, 0x4A, 0x6A, 0x20, 0x00}
+
+	var samples []byte
+	for _, data := range [][]byte{temperature, humidity, temperature} {
+		samples = append(samples, m.Silence(2500)...)
+		samples = append(samples, m.Packet(data)...)
+	}
+	samples = append(samples, m.Silence(2500)...)
+
+	msgs := decode(samples)
+	if len(msgs) != 3 {
+		t.Fatalf("expected 3 messages, got %d\n", len(msgs))
+	}
+	if msgs[1].Sensor != protocol.Humidity || msgs[1].Value != 61.8 {
+		t.Fatalf("bad humidity: %s\n", msgs[1])
+	}
+}
@@ -0,0 +1,256 @@
+/*
+   rtldavis, an rtl-sdr receiver for Davis Instruments weather stations.
+   Copyright (C) 2015  Douglas Hall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package mqtt
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"time"
+)
+
+// ErrQueueFull is returned by Publish when messages are being published
+// faster than they can be sent, usually because the broker is unreachable.
+var ErrQueueFull = errors.New("mqtt: publish queue full")
+
+// Options configures a Client.
+type Options struct {
+	// Addr is the broker's host:port.
+	Addr     string
+	ClientID string
+	Username string
+	Password string
+
+	// KeepAlive is the interval at which the client pings the broker.
+	KeepAlive time.Duration
+
+	// After losing its connection the client waits MinBackoff before
+	// reconnecting, doubling the wait after each failed attempt up to
+	// MaxBackoff.
+	MinBackoff, MaxBackoff time.Duration
+
+	// QueueLength is the number of messages buffered while disconnected.
+	QueueLength int
+
+	// Logger receives connection errors, discarded if nil.
+	Logger *log.Logger
+}
+
+// DefaultOptions returns options for connecting to the broker at addr.
+func DefaultOptions(addr string) Options {
+	return Options{
+		Addr:        addr,
+		ClientID:    "rtldavis",
+		KeepAlive:   30 * time.Second,
+		MinBackoff:  time.Second,
+		MaxBackoff:  2 * time.Minute,
+		QueueLength: 256,
+	}
+}
+
+type publish struct {
+	topic   string
+	payload []byte
+	retain  bool
+}
+
+// Client is a publish-only MQTT 3.1.1 client. Messages are published at QoS
+// 0 from a background goroutine which maintains the connection to the
+// broker, reconnecting with exponential backoff when it's lost.
+type Client struct {
+	opts Options
+
+	queue chan publish
+	done  chan struct{}
+	exit  chan struct{}
+}
+
+// NewClient returns a client and starts connecting to the broker.
+func NewClient(opts Options) *Client {
+	if opts.Logger == nil {
+		opts.Logger = log.New(ioutil.Discard, "", 0)
+	}
+
+	c := &Client{
+		opts:  opts,
+		queue: make(chan publish, opts.QueueLength),
+		done:  make(chan struct{}),
+		exit:  make(chan struct{}),
+	}
+	go c.run()
+
+	return c
+}
+
+// Publish queues a message for the broker.
+func (c *Client) Publish(topic string, payload []byte, retain bool) error {
+	select {
+	case c.queue <- publish{topic, payload, retain}:
+		return nil
+	default:
+		return ErrQueueFull
+	}
+}
+
+// Close disconnects from the broker. Messages still queued are discarded.
+func (c *Client) Close() error {
+	close(c.done)
+	<-c.exit
+	return nil
+}
+
+func (c *Client) run() {
+	defer close(c.exit)
+
+	// A message we failed to send is retried once we've reconnected.
+	var pending *publish
+
+	backoff := c.opts.MinBackoff
+	for {
+		conn, r, err := c.connect()
+		if err == nil {
+			backoff = c.opts.MinBackoff
+			pending, err = c.serve(conn, r, pending)
+			conn.Close()
+			if err == nil {
+				return
+			}
+		}
+		c.opts.Logger.Printf("mqtt: %s, reconnecting in %s\n", err, backoff)
+
+		select {
+		case <-time.After(backoff):
+		case <-c.done:
+			return
+		}
+
+		backoff <<= 1
+		if backoff > c.opts.MaxBackoff {
+			backoff = c.opts.MaxBackoff
+		}
+	}
+}
+
+func (c *Client) connect() (net.Conn, *bufio.Reader, error) {
+	conn, err := net.DialTimeout("tcp", c.opts.Addr, 10*time.Second)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keepAlive := uint16(c.opts.KeepAlive / time.Second)
+	connect := connectPacket(c.opts.ClientID, c.opts.Username, c.opts.Password, keepAlive)
+	if _, err := connect.WriteTo(conn); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	r := bufio.NewReader(conn)
+	ack, err := readPacket(r)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	if ack.kind() != typeConnAck || len(ack.body) != 2 {
+		conn.Close()
+		return nil, nil, fmt.Errorf("expected CONNACK, got packet type 0x%02X", ack.header)
+	}
+	if ack.body[1] != 0 {
+		conn.Close()
+		return nil, nil, ConnAckError(ack.body[1])
+	}
+
+	return conn, r, nil
+}
+
+// serve sends queued messages until the client is closed, returning nil, or
+// the connection fails, returning the error and the message that failed to
+// send, if any.
+func (c *Client) serve(conn net.Conn, r *bufio.Reader, pending *publish) (*publish, error) {
+	// The only packets a publish-only client receives are PINGRESP, read
+	// them in the background so a dead connection is noticed.
+	readErr := make(chan error, 1)
+	pong := make(chan struct{}, 1)
+	go func() {
+		for {
+			p, err := readPacket(r)
+			if err != nil {
+				readErr <- err
+				return
+			}
+			if p.kind() != typePingResp {
+				readErr <- fmt.Errorf("unexpected packet type 0x%02X", p.header)
+				return
+			}
+			select {
+			case pong <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	keepAlive := c.opts.KeepAlive
+	if keepAlive <= 0 {
+		keepAlive = time.Hour
+	}
+	ping := time.NewTicker(keepAlive)
+	defer ping.Stop()
+	awaitingPong := false
+
+	send := func(p packet) error {
+		conn.SetWriteDeadline(time.Now().Add(keepAlive))
+		_, err := p.WriteTo(conn)
+		return err
+	}
+
+	if pending != nil {
+		if err := send(publishPacket(pending.topic, pending.payload, pending.retain)); err != nil {
+			return pending, err
+		}
+	}
+
+	for {
+		select {
+		case msg := <-c.queue:
+			if err := send(publishPacket(msg.topic, msg.payload, msg.retain)); err != nil {
+				return &msg, err
+			}
+		case <-ping.C:
+			// The broker has had a whole keep alive interval to respond.
+			if awaitingPong {
+				return nil, errors.New("ping timeout")
+			}
+			if err := send(packet{typePingReq, nil}); err != nil {
+				return nil, err
+			}
+			awaitingPong = true
+		case <-pong:
+			awaitingPong = false
+		case err := <-readErr:
+			return nil, err
+		case <-c.done:
+			send(packet{typeDisconnect, nil})
+			return nil, nil
+		}
+	}
+}
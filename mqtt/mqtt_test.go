@@ -0,0 +1,280 @@
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bemasher/rtldavis/dsp"
+	"github.com/bemasher/rtldavis/protocol"
+	"github.com/bemasher/rtldavis/weather"
+)
+
+func TestRemainingLength(t *testing.T) {
+	for _, length := range []int{0, 1, 127, 128, 16383, 16384, 2097151, 2097152} {
+		var buf bytes.Buffer
+		if _, err := (packet{typePublish, make([]byte, length)}).WriteTo(&buf); err != nil {
+			t.Fatal(err)
+		}
+
+		p, err := readPacket(bufio.NewReader(&buf))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.header != typePublish || len(p.body) != length {
+			t.Fatalf("expected length %d, got %d\n", length, len(p.body))
+		}
+	}
+}
+
+type received struct {
+	Topic   string
+	Payload string
+	Retain  bool
+}
+
+// broker is a minimal in-process MQTT broker. It refuses the first refuse
+// connections and closes each accepted connection after dropAfter publishes
+// if non-zero.
+type broker struct {
+	l net.Listener
+
+	refuse    int
+	dropAfter int
+
+	connects  chan string
+	publishes chan received
+}
+
+func newBroker(t *testing.T, refuse, dropAfter int) *broker {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := &broker{
+		l:         l,
+		refuse:    refuse,
+		dropAfter: dropAfter,
+		connects:  make(chan string, 16),
+		publishes: make(chan received, 64),
+	}
+	go b.serve()
+
+	return b
+}
+
+func (b *broker) serve() {
+	for {
+		conn, err := b.l.Accept()
+		if err != nil {
+			return
+		}
+		b.handle(conn)
+	}
+}
+
+func (b *broker) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	connect, err := readPacket(r)
+	if err != nil || connect.kind() != typeConnect {
+		return
+	}
+
+	// Skip the protocol name, level, flags and keep alive.
+	_, rest, _ := readString(connect.body)
+	clientID, _, _ := readString(rest[4:])
+
+	if b.refuse > 0 {
+		b.refuse--
+		packet{typeConnAck, []byte{0, 3}}.WriteTo(conn)
+		return
+	}
+	packet{typeConnAck, []byte{0, 0}}.WriteTo(conn)
+	b.connects <- clientID
+
+	count := 0
+	for {
+		p, err := readPacket(r)
+		if err != nil {
+			return
+		}
+
+		switch p.kind() {
+		case typePublish:
+			topic, payload, _ := readString(p.body)
+			b.publishes <- received{topic, string(payload), p.header&publishRetain != 0}
+			count++
+			if count == b.dropAfter {
+				return
+			}
+		case typePingReq:
+			packet{typePingResp, nil}.WriteTo(conn)
+		case typeDisconnect:
+			return
+		}
+	}
+}
+
+func (b *broker) options() Options {
+	opts := DefaultOptions(b.l.Addr().String())
+	opts.MinBackoff = 10 * time.Millisecond
+	opts.MaxBackoff = 50 * time.Millisecond
+	return opts
+}
+
+func (b *broker) next(t *testing.T) received {
+	select {
+	case r := <-b.publishes:
+		return r
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for publish")
+	}
+	return received{}
+}
+
+func (b *broker) connected(t *testing.T) string {
+	select {
+	case clientID := <-b.connects:
+		return clientID
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for connection")
+	}
+	return ""
+}
+
+func TestPublisher(t *testing.T) {
+	b := newBroker(t, 0, 0)
+	defer b.l.Close()
+
+	c := NewClient(b.options())
+	defer c.Close()
+
+	if clientID := b.connected(t); clientID != "rtldavis" {
+		t.Fatalf("expected client id rtldavis, got %q\n", clientID)
+	}
+
+	msg := protocol.NewMessage(dsp.Packet{Data: []byte{0xCB, 0x89, 0x81, 0x05, 0x4A, 0x2D, 0x50, 0x00, 0x12, 0x34}})
+	msg.RSSI = -20.5
+	msg.SNR = 30.26
+
+	p := NewPublisher(c, "weather", true, "homeassistant")
+	p.Wind.Encoding = weather.Vue
+	if err := p.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []received{
+		{"homeassistant/sensor/rtldavis_1_wind_speed/config", "", true},
+		{"weather/1/wind_speed", "5", true},
+		{"homeassistant/sensor/rtldavis_1_wind_direction/config", "", true},
+		{"weather/1/wind_direction", "104.3625", true},
+		{"homeassistant/sensor/rtldavis_1_rssi/config", "", true},
+		{"weather/1/rssi", "-20.5", true},
+		{"homeassistant/sensor/rtldavis_1_snr/config", "", true},
+		{"weather/1/snr", "30.3", true},
+		{"homeassistant/sensor/rtldavis_1_temperature/config", "", true},
+		{"weather/1/temperature", "72.5", true},
+		{"weather/1/message", "", true},
+	}
+
+	for _, e := range expected {
+		r := b.next(t)
+		if r.Topic != e.Topic || r.Retain != e.Retain || (e.Payload != "" && r.Payload != e.Payload) {
+			t.Fatalf("expected %+v, got %+v\n", e, r)
+		}
+
+		if r.Topic == "homeassistant/sensor/rtldavis_1_temperature/config" {
+			var cfg discoveryConfig
+			if err := json.Unmarshal([]byte(r.Payload), &cfg); err != nil {
+				t.Fatal(err)
+			}
+			if cfg.StateTopic != "weather/1/temperature" || cfg.DeviceClass != "temperature" {
+				t.Fatalf("bad discovery config: %s\n", r.Payload)
+			}
+		}
+	}
+
+	// Discovery payloads are only sent once.
+	if err := p.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	if r := b.next(t); r.Topic != "weather/1/wind_speed" {
+		t.Fatalf("expected weather/1/wind_speed, got %s\n", r.Topic)
+	}
+	for n := 0; n < 5; n++ {
+		b.next(t)
+	}
+
+	// Conditions are published under their own node.
+	cond := weather.NewConditions(1, 1)
+	cond.WindChill = weather.Reading{Value: 72.5, Time: time.Now()}
+	if err := p.WriteConditions(cond); err != nil {
+		t.Fatal(err)
+	}
+	r := b.next(t)
+	var cfg discoveryConfig
+	if err := json.Unmarshal([]byte(r.Payload), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if r.Topic != "homeassistant/sensor/rtldavis_conditions_wind_chill/config" || cfg.StateTopic != "weather/conditions/wind_chill" ||
+		cfg.DeviceClass != "temperature" || cfg.Device.Name != "Davis station" {
+		t.Fatalf("bad discovery config at %s: %s\n", r.Topic, r.Payload)
+	}
+	if r := b.next(t); r.Topic != "weather/conditions/wind_chill" || r.Payload != "72.5" {
+		t.Fatalf("expected weather/conditions/wind_chill 72.5, got %+v\n", r)
+	}
+
+	// Rain rate is a precipitation intensity in inches per hour, but not in
+	// a transmitter's bucket tips per hour.
+	for _, node := range []string{conditionsNode, "1"} {
+		unit := "in/h"
+		if node != conditionsNode {
+			unit = protocol.RainRate.Unit()
+		}
+		if err := p.discover(node, "rain_rate", unit); err != nil {
+			t.Fatal(err)
+		}
+		r := b.next(t)
+		var cfg discoveryConfig
+		if err := json.Unmarshal([]byte(r.Payload), &cfg); err != nil {
+			t.Fatal(err)
+		}
+		if class := cfg.DeviceClass; (node == conditionsNode) != (class == "precipitation_intensity") {
+			t.Fatalf("bad rain rate device class for %s in %s: %q\n", node, unit, class)
+		}
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	b := newBroker(t, 2, 1)
+	defer b.l.Close()
+
+	c := NewClient(b.options())
+	defer c.Close()
+
+	// Refused twice before being accepted.
+	b.connected(t)
+
+	if err := c.Publish("a", []byte("1"), false); err != nil {
+		t.Fatal(err)
+	}
+	if r := b.next(t); r.Topic != "a" {
+		t.Fatalf("expected a, got %s\n", r.Topic)
+	}
+
+	// The broker drops the connection after the first publish.
+	b.connected(t)
+
+	if err := c.Publish("b", []byte("2"), false); err != nil {
+		t.Fatal(err)
+	}
+	if r := b.next(t); r.Topic != "b" {
+		t.Fatalf("expected b, got %s\n", r.Topic)
+	}
+}
@@ -0,0 +1,186 @@
+/*
+   rtldavis, an rtl-sdr receiver for Davis Instruments weather stations.
+   Copyright (C) 2015  Douglas Hall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package mqtt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Control packet types, already shifted into the upper nibble of the fixed
+// header.
+const (
+	typeConnect    = 0x10
+	typeConnAck    = 0x20
+	typePublish    = 0x30
+	typePingReq    = 0xC0
+	typePingResp   = 0xD0
+	typeDisconnect = 0xE0
+)
+
+// Flags in the variable header of a CONNECT packet.
+const (
+	connectCleanSession = 0x02
+	connectPassword     = 0x40
+	connectUsername     = 0x80
+)
+
+// Flag in the fixed header of a PUBLISH packet.
+const publishRetain = 0x01
+
+// The largest value the variable length encoding can represent.
+const maxRemainingLength = 268435455
+
+var errMalformedLength = errors.New("malformed remaining length")
+
+// packet is a raw MQTT control packet.
+type packet struct {
+	header byte
+	body   []byte
+}
+
+func (p packet) kind() byte {
+	return p.header & 0xF0
+}
+
+func (p packet) WriteTo(w io.Writer) (int64, error) {
+	if len(p.body) > maxRemainingLength {
+		return 0, fmt.Errorf("packet too large: %d", len(p.body))
+	}
+
+	buf := make([]byte, 0, len(p.body)+5)
+	buf = append(buf, p.header)
+
+	// Remaining length is encoded 7 bits at a time, least significant
+	// first, with the high bit set on all but the last byte.
+	length := len(p.body)
+	for {
+		b := byte(length & 0x7F)
+		length >>= 7
+		if length > 0 {
+			b |= 0x80
+		}
+		buf = append(buf, b)
+		if length == 0 {
+			break
+		}
+	}
+	buf = append(buf, p.body...)
+
+	n, err := w.Write(buf)
+	return int64(n), err
+}
+
+func readPacket(r *bufio.Reader) (p packet, err error) {
+	if p.header, err = r.ReadByte(); err != nil {
+		return p, err
+	}
+
+	length, shift := 0, uint(0)
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return p, err
+		}
+		length |= int(b&0x7F) << shift
+		if b&0x80 == 0 {
+			break
+		}
+		shift += 7
+		if shift > 21 {
+			return p, errMalformedLength
+		}
+	}
+
+	p.body = make([]byte, length)
+	_, err = io.ReadFull(r, p.body)
+	return p, err
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = append(buf, byte(len(s)>>8), byte(len(s)))
+	return append(buf, s...)
+}
+
+func readString(buf []byte) (s string, rest []byte, err error) {
+	if len(buf) < 2 {
+		return "", nil, io.ErrUnexpectedEOF
+	}
+	length := int(binary.BigEndian.Uint16(buf))
+	if len(buf) < 2+length {
+		return "", nil, io.ErrUnexpectedEOF
+	}
+	return string(buf[2 : 2+length]), buf[2+length:], nil
+}
+
+func connectPacket(clientID, username, password string, keepAlive uint16) packet {
+	var flags byte = connectCleanSession
+	if username != "" {
+		flags |= connectUsername
+	}
+	if password != "" {
+		flags |= connectPassword
+	}
+
+	body := appendString(nil, "MQTT")
+	body = append(body, 4, flags, byte(keepAlive>>8), byte(keepAlive))
+	body = appendString(body, clientID)
+	if username != "" {
+		body = appendString(body, username)
+	}
+	if password != "" {
+		body = appendString(body, password)
+	}
+
+	return packet{typeConnect, body}
+}
+
+func publishPacket(topic string, payload []byte, retain bool) packet {
+	header := byte(typePublish)
+	if retain {
+		header |= publishRetain
+	}
+
+	body := appendString(nil, topic)
+	body = append(body, payload...)
+
+	return packet{header, body}
+}
+
+// ConnAckError is returned when the broker refuses a connection.
+type ConnAckError byte
+
+func (e ConnAckError) Error() string {
+	switch e {
+	case 1:
+		return "connection refused: unacceptable protocol version"
+	case 2:
+		return "connection refused: identifier rejected"
+	case 3:
+		return "connection refused: server unavailable"
+	case 4:
+		return "connection refused: bad user name or password"
+	case 5:
+		return "connection refused: not authorized"
+	default:
+		return fmt.Sprintf("connection refused: code %d", byte(e))
+	}
+}
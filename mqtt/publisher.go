@@ -0,0 +1,247 @@
+/*
+   rtldavis, an rtl-sdr receiver for Davis Instruments weather stations.
+   Copyright (C) 2015  Douglas Hall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package mqtt
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/bemasher/rtldavis/protocol"
+	"github.com/bemasher/rtldavis/weather"
+)
+
+// Publisher publishes decoded messages to a broker. Each valid sensor reading
+// is published to Prefix/<id>/<sensor>, wind speed and direction carried by
+// every message to Prefix/<id>/wind_speed and Prefix/<id>/wind_direction,
+// signal strength to Prefix/<id>/rssi and Prefix/<id>/snr, and the whole
+// message as JSON to Prefix/<id>/message. The derived values, wind averages,
+// ET and rain totals of the conditions are published to
+// Prefix/conditions/<key>.
+type Publisher struct {
+	Client *Client
+	Prefix string
+	Retain bool
+
+	// Wind decodes the wind direction of each message to degrees.
+	Wind weather.Wind
+
+	// If DiscoveryPrefix isn't empty, Home Assistant discovery payloads are
+	// published under it the first time each reading is seen.
+	DiscoveryPrefix string
+
+	discovered map[string]bool
+}
+
+func NewPublisher(client *Client, prefix string, retain bool, discoveryPrefix string) *Publisher {
+	return &Publisher{
+		Client:          client,
+		Prefix:          prefix,
+		Retain:          retain,
+		DiscoveryPrefix: discoveryPrefix,
+		discovered:      make(map[string]bool),
+	}
+}
+
+// reading is a single value published to its own topic.
+type reading struct {
+	key, unit string
+	value     float64
+}
+
+func (p *Publisher) Write(msg protocol.Message) error {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	values := []reading{
+		{"wind_speed", "mph", float64(msg.WindSpeed)},
+		{"wind_direction", "°", p.Wind.Direction(msg.WindDirection)},
+		{"rssi", "dBFS", round(msg.RSSI)},
+		{"snr", "dB", round(msg.SNR)},
+	}
+	if msg.Valid {
+		values = append(values, reading{msg.Sensor.Key(), msg.Sensor.Unit(), msg.Value})
+	}
+
+	node := strconv.Itoa(int(msg.ID))
+	if err := p.publish(node, values); err != nil {
+		return err
+	}
+
+	return p.Client.Publish(p.topic(node, "message"), payload, p.Retain)
+}
+
+// conditionsNode is the topic level the conditions are published under, in
+// place of a transmitter id.
+const conditionsNode = "conditions"
+
+func (p *Publisher) WriteConditions(c weather.Conditions) error {
+	var values []reading
+	for _, v := range c.Values() {
+		values = append(values, reading{v.Key, v.Unit, v.Value})
+	}
+	return p.publish(conditionsNode, values)
+}
+
+// publish publishes each reading to its own topic under node.
+func (p *Publisher) publish(node string, values []reading) error {
+	for _, v := range values {
+		if err := p.discover(node, v.key, v.unit); err != nil {
+			return err
+		}
+
+		value := strconv.FormatFloat(v.value, 'f', -1, 64)
+		if err := p.Client.Publish(p.topic(node, v.key), []byte(value), p.Retain); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// round rounds signal strengths to a tenth of a dB, anything finer is noise.
+func round(db float64) float64 {
+	return math.Floor(db*10+0.5) / 10
+}
+
+func (p *Publisher) topic(node, key string) string {
+	return fmt.Sprintf("%s/%s/%s", p.Prefix, node, key)
+}
+
+// discoveryConfig is a Home Assistant MQTT sensor discovery payload.
+type discoveryConfig struct {
+	Name              string          `json:"name"`
+	UniqueID          string          `json:"unique_id"`
+	StateTopic        string          `json:"state_topic"`
+	UnitOfMeasurement string          `json:"unit_of_measurement,omitempty"`
+	DeviceClass       string          `json:"device_class,omitempty"`
+	StateClass        string          `json:"state_class"`
+	EntityCategory    string          `json:"entity_category,omitempty"`
+	Device            discoveryDevice `json:"device"`
+}
+
+type discoveryDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer"`
+}
+
+// deviceClasses maps reading keys to Home Assistant device classes.
+var deviceClasses = map[string]string{
+	"temperature":          "temperature",
+	"humidity":             "humidity",
+	"solar_radiation":      "irradiance",
+	"supercap_voltage":     "voltage",
+	"wind_speed":           "wind_speed",
+	"wind_gust_speed":      "wind_speed",
+	"dew_point":            "temperature",
+	"heat_index":           "temperature",
+	"wind_chill":           "temperature",
+	"thw_index":            "temperature",
+	"thsw_index":           "temperature",
+	"apparent_temperature": "temperature",
+	"wind_speed_2m":        "wind_speed",
+	"wind_speed_10m":       "wind_speed",
+	"wind_gust_10m":        "wind_speed",
+	"rain_day":             "precipitation",
+	"rain_month":           "precipitation",
+	"rain_year":            "precipitation",
+	"rain_storm":           "precipitation",
+}
+
+// conditionsClasses maps the keys of conditions to Home Assistant device
+// classes where a transmitter's reading of the same name is in units the
+// class doesn't accept, such as a rain rate in bucket tips.
+var conditionsClasses = map[string]string{
+	"rain_rate": "precipitation_intensity",
+}
+
+// totals are the reading keys that only increase until they're reset.
+var totals = map[string]bool{
+	"day_et":     true,
+	"rain_day":   true,
+	"rain_month": true,
+	"rain_year":  true,
+	"rain_storm": true,
+}
+
+// diagnostics are the reading keys describing the radio link rather than the
+// weather.
+var diagnostics = map[string]bool{
+	"rssi": true,
+	"snr":  true,
+}
+
+func (p *Publisher) discover(node, key, unit string) error {
+	if p.DiscoveryPrefix == "" {
+		return nil
+	}
+
+	objectID := fmt.Sprintf("rtldavis_%s_%s", node, key)
+	if p.discovered[objectID] {
+		return nil
+	}
+
+	device := "Davis transmitter " + node
+	if node == conditionsNode {
+		device = "Davis station"
+	}
+
+	deviceClass := deviceClasses[key]
+	if node == conditionsNode && conditionsClasses[key] != "" {
+		deviceClass = conditionsClasses[key]
+	}
+
+	cfg := discoveryConfig{
+		Name:              fmt.Sprintf("Davis %s %s", node, key),
+		UniqueID:          objectID,
+		StateTopic:        p.topic(node, key),
+		UnitOfMeasurement: unit,
+		DeviceClass:       deviceClass,
+		StateClass:        "measurement",
+		Device: discoveryDevice{
+			Identifiers:  []string{"rtldavis_" + node},
+			Name:         device,
+			Manufacturer: "Davis Instruments",
+		},
+	}
+
+	if diagnostics[key] {
+		cfg.EntityCategory = "diagnostic"
+	}
+	if totals[key] {
+		cfg.StateClass = "total_increasing"
+	}
+
+	payload, err := json.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+
+	// Discovery payloads are always retained so Home Assistant sees them
+	// when it restarts.
+	topic := fmt.Sprintf("%s/sensor/%s/config", p.DiscoveryPrefix, objectID)
+	if err := p.Client.Publish(topic, payload, true); err != nil {
+		return err
+	}
+
+	p.discovered[objectID] = true
+	return nil
+}
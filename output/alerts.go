@@ -0,0 +1,78 @@
+/*
+   rtldavis, an rtl-sdr receiver for Davis Instruments weather stations.
+   Copyright (C) 2015  Douglas Hall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package output
+
+import (
+	"log"
+
+	"github.com/bemasher/rtldavis/protocol"
+)
+
+// superCapHysteresis is how far above the threshold supercap voltage must
+// rise before a low voltage alert clears, so a voltage hovering around the
+// threshold doesn't alert with every reading.
+const superCapHysteresis = 0.1
+
+// Alerts is a sink logging when a transmitter reports a low battery or its
+// supercap voltage falls below a threshold, and again when either recovers.
+type Alerts struct {
+	// SuperCapLow is the supercap voltage below which to alert, disabled if
+	// zero.
+	SuperCapLow float64
+
+	logger   *log.Logger
+	battery  map[byte]bool
+	superCap map[byte]bool
+}
+
+func NewAlerts(logger *log.Logger, superCapLow float64) *Alerts {
+	return &Alerts{
+		SuperCapLow: superCapLow,
+		logger:      logger,
+		battery:     make(map[byte]bool),
+		superCap:    make(map[byte]bool),
+	}
+}
+
+func (a *Alerts) Write(msg protocol.Message) error {
+	low, seen := a.battery[msg.ID]
+	if msg.BatteryLow != low && (seen || msg.BatteryLow) {
+		if msg.BatteryLow {
+			a.logger.Printf("transmitter %d: battery low\n", msg.ID)
+		} else {
+			a.logger.Printf("transmitter %d: battery ok\n", msg.ID)
+		}
+	}
+	a.battery[msg.ID] = msg.BatteryLow
+
+	if a.SuperCapLow <= 0 || msg.Sensor != protocol.SuperCapVoltage || !msg.Valid {
+		return nil
+	}
+
+	low = a.superCap[msg.ID]
+	switch {
+	case !low && msg.Value < a.SuperCapLow:
+		a.logger.Printf("transmitter %d: supercap voltage low: %0.2fV\n", msg.ID, msg.Value)
+		a.superCap[msg.ID] = true
+	case low && msg.Value >= a.SuperCapLow+superCapHysteresis:
+		a.logger.Printf("transmitter %d: supercap voltage ok: %0.2fV\n", msg.ID, msg.Value)
+		a.superCap[msg.ID] = false
+	}
+
+	return nil
+}
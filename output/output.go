@@ -0,0 +1,130 @@
+/*
+   rtldavis, an rtl-sdr receiver for Davis Instruments weather stations.
+   Copyright (C) 2015  Douglas Hall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package output
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/bemasher/rtldavis/influx"
+	"github.com/bemasher/rtldavis/protocol"
+	"github.com/bemasher/rtldavis/weather"
+)
+
+// Sink consumes decoded messages.
+type Sink interface {
+	Write(msg protocol.Message) error
+}
+
+// Text writes one line per message with the time it was received, the raw
+// message bytes, the decoded message, its signal strength, the repeater it
+// was heard through and whether the transmitter's battery is low.
+type Text struct {
+	w io.Writer
+}
+
+func NewText(w io.Writer) Text {
+	return Text{w}
+}
+
+func (t Text) Write(msg protocol.Message) error {
+	var flags string
+	if msg.Repeater != protocol.NoRepeater {
+		flags += " Repeater:" + msg.Repeater.String()
+	}
+	if msg.BatteryLow {
+		flags += " BatteryLow"
+	}
+
+	_, err := fmt.Fprintf(t.w, "%s %02X %s RSSI:%0.1fdBFS SNR:%0.1fdB%s\n",
+		msg.Time.Format("15:04:05.000000"), msg.Data, msg, msg.RSSI, msg.SNR, flags,
+	)
+	return err
+}
+
+// JSON writes one JSON object per line for each message.
+type JSON struct {
+	enc *json.Encoder
+}
+
+func NewJSON(w io.Writer) JSON {
+	return JSON{json.NewEncoder(w)}
+}
+
+func (j JSON) Write(msg protocol.Message) error {
+	return j.enc.Encode(msg)
+}
+
+// ConditionsJSON is a weather.Sink writing one JSON object per line for the
+// conditions derived from each message, typed "conditions" so they can be
+// told apart from messages written to the same stream.
+type ConditionsJSON struct {
+	enc *json.Encoder
+}
+
+func NewConditionsJSON(w io.Writer) ConditionsJSON {
+	return ConditionsJSON{json.NewEncoder(w)}
+}
+
+type jsonValue struct {
+	Value float64 `json:"value"`
+	Unit  string  `json:"unit,omitempty"`
+}
+
+type jsonConditions struct {
+	Type       string               `json:"type"`
+	Time       time.Time            `json:"time"`
+	Conditions map[string]jsonValue `json:"conditions"`
+}
+
+func (j ConditionsJSON) WriteConditions(c weather.Conditions) error {
+	jc := jsonConditions{Type: "conditions", Time: c.Updated, Conditions: make(map[string]jsonValue)}
+	for _, v := range c.Values() {
+		jc.Conditions[v.Key] = jsonValue{v.Value, v.Unit}
+	}
+	return j.enc.Encode(jc)
+}
+
+// Multi writes each message to all of its sinks.
+type Multi []Sink
+
+func (m Multi) Write(msg protocol.Message) (err error) {
+	for _, sink := range m {
+		if serr := sink.Write(msg); err == nil {
+			err = serr
+		}
+	}
+	return err
+}
+
+// New returns a sink writing messages to w in the named format, "text",
+// "json" or "influx" line protocol. Line protocol carries wind direction in
+// degrees decoded by wind.
+func New(format string, w io.Writer, wind weather.Wind) (Sink, error) {
+	switch format {
+	case "text":
+		return NewText(w), nil
+	case "json":
+		return NewJSON(w), nil
+	case "influx":
+		return influx.NewWriter(w, influx.Measurement, wind), nil
+	}
+	return nil, fmt.Errorf("unknown output format: %q", format)
+}
@@ -0,0 +1,64 @@
+package output
+
+import (
+	"bytes"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/bemasher/rtldavis/dsp"
+	"github.com/bemasher/rtldavis/protocol"
+	"github.com/bemasher/rtldavis/weather"
+)
+
+func TestAlerts(t *testing.T) {
+	var buf bytes.Buffer
+	a := NewAlerts(log.New(&buf, "", 0), 1.5)
+
+	// Temperature from transmitter 1, with and without the battery flag.
+	ok := protocol.NewMessage(dsp.Packet{Data: []byte{0xCB, 0x89, 0x81, 0x05, 0x4A, 0x2D, 0x50, 0x00, 0x12, 0x34}})
+	low := protocol.NewMessage(dsp.Packet{Data: []byte{0xCB, 0x89, 0x89, 0x05, 0x4A, 0x2D, 0x50, 0x00, 0x12, 0x34}})
+	if low.ID != 1 || !low.BatteryLow || ok.BatteryLow {
+		t.Fatalf("expected id 1 with battery flag, got id %d battery %v\n", low.ID, low.BatteryLow)
+	}
+
+	superCap := func(volts float64) protocol.Message {
+		msg := ok
+		msg.Sensor, msg.Value, msg.Valid = protocol.SuperCapVoltage, volts, true
+		return msg
+	}
+
+	for _, msg := range []protocol.Message{
+		ok, ok, low, low, ok,
+		superCap(2.0), superCap(1.4), superCap(1.3), superCap(1.55), superCap(1.6),
+	} {
+		a.Write(msg)
+	}
+
+	expected := "transmitter 1: battery low\n" +
+		"transmitter 1: battery ok\n" +
+		"transmitter 1: supercap voltage low: 1.40V\n" +
+		"transmitter 1: supercap voltage ok: 1.60V\n"
+	if buf.String() != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s\n", expected, buf.String())
+	}
+}
+
+func TestConditionsJSON(t *testing.T) {
+	var buf bytes.Buffer
+
+	msg := protocol.NewMessage(dsp.Packet{Data: []byte{0xCB, 0x89, 0x81, 0x05, 0x4A, 0x2D, 0x50, 0x00, 0x12, 0x34}})
+	msg.Time = time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)
+	NewJSON(&buf).Write(msg)
+
+	c := weather.NewConditions(1, 1)
+	c.Updated = msg.Time
+	c.WindChill = weather.Reading{Value: 72.5, Time: msg.Time}
+	NewConditionsJSON(&buf).WriteConditions(c)
+
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	expected := `{"type":"conditions","time":"2015-06-01T12:00:00Z","conditions":{"wind_chill":{"value":72.5,"unit":"°F"}}}`
+	if len(lines) != 2 || bytes.Contains(lines[0], []byte(`"type"`)) || string(lines[1]) != expected {
+		t.Fatalf("expected a message then %s, got:\n%s\n", expected, buf.String())
+	}
+}
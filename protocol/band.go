@@ -0,0 +1,153 @@
+/*
+   rtldavis, an rtl-sdr receiver for Davis Instruments weather stations.
+   Copyright (C) 2015  Douglas Hall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package protocol
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// TuningOffset is how far above a channel the receiver tunes, placing the
+// transmitter near a quarter of the sample rate below center where the
+// demodulator expects it.
+const TuningOffset = 63503
+
+// Band is a regional frequency plan: the frequencies transmitters hop
+// between, the order they're visited in and how long a transmitter dwells on
+// each.
+type Band struct {
+	Name       string
+	Channels   []int
+	HopPattern []int
+
+	// A transmitter with id n dwells on each channel for
+	// DwellTime + n*DwellStep.
+	DwellTime time.Duration
+	DwellStep time.Duration
+}
+
+// Dwell returns the dwell time of the transmitter with the given id.
+func (b Band) Dwell(id int) time.Duration {
+	return b.DwellTime + time.Duration(id)*b.DwellStep
+}
+
+// SyncWait returns how long to wait on a single channel for the transmitter
+// with the given id: one full rotation of the pattern plus one dwell.
+func (b Band) SyncWait(id int) time.Duration {
+	return time.Duration(len(b.HopPattern)+1) * b.Dwell(id)
+}
+
+func (b Band) String() string {
+	return b.Name
+}
+
+// US is the 902-928 MHz plan used in North America.
+var US = Band{
+	Name: "us",
+	Channels: []int{
+		902292332, 902794082, 903295833, 903797583, 904299334, 904801084,
+		905302835, 905804585, 906306336, 906808086, 907309837, 907811587,
+		908313338, 908815088, 909316839, 909818589, 910320340, 910822090,
+		911323841, 911825591, 912327342, 912829092, 913330843, 913832593,
+		914334344, 914836094, 915337844, 915839595, 916341345, 916843096,
+		917344846, 917846597, 918348347, 918850098, 919351848, 919853599,
+		920355349, 920857100, 921358850, 921860601, 922362351, 922864102,
+		923365852, 923867603, 924369353, 924871104, 925372854, 925874605,
+		926376355, 926878106, 927379856,
+	},
+	HopPattern: []int{
+		0, 19, 41, 25, 8, 47, 32, 13, 36, 22, 3, 29, 44, 16, 5, 27, 38, 10,
+		49, 21, 2, 30, 42, 14, 48, 7, 24, 34, 45, 1, 17, 39, 26, 9, 31, 50,
+		37, 12, 20, 33, 4, 43, 28, 15, 35, 6, 40, 11, 23, 46, 18,
+	},
+	DwellTime: 2562500 * time.Microsecond,
+	DwellStep: 62500 * time.Microsecond,
+}
+
+// EU is the 868 MHz plan used in Europe.
+var EU = Band{
+	Name: "eu",
+	Channels: []int{
+		868066346, 868181651, 868296957, 868412262, 868527567,
+	},
+	HopPattern: []int{
+		0, 2, 4, 1, 3,
+	},
+	DwellTime: 2562500 * time.Microsecond,
+	DwellStep: 62500 * time.Microsecond,
+}
+
+// AU is the 918-926 MHz plan used in Australia.
+var AU = Band{
+	Name: "au",
+	Channels: []int{
+		918100580, 918250214, 918399847, 918549480, 918699114, 918848748,
+		918998381, 919148014, 919297648, 919447282, 919596915, 919746548,
+		919896182, 920045816, 920195449, 920345082, 920494716, 920644350,
+		920793983, 920943616, 921093250, 921242884, 921392517, 921542150,
+		921691784, 921841418, 921991051, 922140684, 922290318, 922439952,
+		922589585, 922739218, 922888852, 923038486, 923188119, 923337752,
+		923487386, 923637020, 923786653, 923936286, 924085920, 924235554,
+		924385187, 924534820, 924684454, 924834088, 924983721, 925133354,
+		925282988, 925432622, 925582255,
+	},
+	HopPattern: []int{
+		0, 13, 26, 39, 1, 14, 27, 40, 2, 15, 28, 41, 3, 16, 29, 42, 4, 17, 30,
+		43, 5, 18, 31, 44, 6, 19, 32, 45, 7, 20, 33, 46, 8, 21, 34, 47, 9, 22,
+		35, 48, 10, 23, 36, 49, 11, 24, 37, 50, 12, 25, 38,
+	},
+	DwellTime: 2562500 * time.Microsecond,
+	DwellStep: 62500 * time.Microsecond,
+}
+
+// NZ is the 921-928 MHz plan used in New Zealand.
+var NZ = Band{
+	Name: "nz",
+	Channels: []int{
+		921100000, 921236000, 921372000, 921508000, 921644000, 921780000,
+		921916000, 922052000, 922188000, 922324000, 922460000, 922596000,
+		922732000, 922868000, 923004000, 923140000, 923276000, 923412000,
+		923548000, 923684000, 923820000, 923956000, 924092000, 924228000,
+		924364000, 924500000, 924636000, 924772000, 924908000, 925044000,
+		925180000, 925316000, 925452000, 925588000, 925724000, 925860000,
+		925996000, 926132000, 926268000, 926404000, 926540000, 926676000,
+		926812000, 926948000, 927084000, 927220000, 927356000, 927492000,
+		927628000, 927764000, 927900000,
+	},
+	HopPattern: []int{
+		0, 13, 26, 39, 1, 14, 27, 40, 2, 15, 28, 41, 3, 16, 29, 42, 4, 17, 30,
+		43, 5, 18, 31, 44, 6, 19, 32, 45, 7, 20, 33, 46, 8, 21, 34, 47, 9, 22,
+		35, 48, 10, 23, 36, 49, 11, 24, 37, 50, 12, 25, 38,
+	},
+	DwellTime: 2562500 * time.Microsecond,
+	DwellStep: 62500 * time.Microsecond,
+}
+
+// Bands lists the known frequency plans.
+var Bands = []Band{US, EU, AU, NZ}
+
+// LookupBand returns the frequency plan with the given name.
+func LookupBand(name string) (Band, error) {
+	for _, b := range Bands {
+		if strings.EqualFold(b.Name, name) {
+			return b, nil
+		}
+	}
+	return Band{}, fmt.Errorf("unknown band: %q", name)
+}
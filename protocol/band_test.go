@@ -0,0 +1,30 @@
+package protocol
+
+import "testing"
+
+func TestBands(t *testing.T) {
+	for _, b := range Bands {
+		if len(b.HopPattern) != len(b.Channels) {
+			t.Fatalf("%s: %d channels but pattern has %d hops\n", b, len(b.Channels), len(b.HopPattern))
+		}
+
+		// The pattern must visit every channel exactly once.
+		visited := make([]bool, len(b.Channels))
+		for _, channel := range b.HopPattern {
+			if channel < 0 || channel >= len(b.Channels) || visited[channel] {
+				t.Fatalf("%s: bad hop pattern entry %d\n", b, channel)
+			}
+			visited[channel] = true
+		}
+
+		for idx := 1; idx < len(b.Channels); idx++ {
+			if b.Channels[idx] <= b.Channels[idx-1] {
+				t.Fatalf("%s: channels not increasing at %d\n", b, idx)
+			}
+		}
+
+		if lookup, err := LookupBand(b.Name); err != nil || lookup.Name != b.Name {
+			t.Fatalf("%s: lookup failed: %v\n", b, err)
+		}
+	}
+}
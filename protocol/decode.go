@@ -0,0 +1,153 @@
+/*
+   rtldavis, an rtl-sdr receiver for Davis Instruments weather stations.
+   Copyright (C) 2015  Douglas Hall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package protocol
+
+import "fmt"
+
+// Key returns a lower-case identifier for the sensor suitable for use in
+// topics, field names and labels.
+func (s Sensor) Key() string {
+	switch s {
+	case SuperCapVoltage:
+		return "supercap_voltage"
+	case UVIndex:
+		return "uv_index"
+	case RainRate:
+		return "rain_rate"
+	case SolarRadiation:
+		return "solar_radiation"
+	case Light:
+		return "light"
+	case Temperature:
+		return "temperature"
+	case WindGustSpeed:
+		return "wind_gust_speed"
+	case Humidity:
+		return "humidity"
+	case Rain:
+		return "rain"
+	default:
+		return fmt.Sprintf("unknown_%x", byte(s))
+	}
+}
+
+// Unit returns the units of the values produced by Decode for this sensor.
+func (s Sensor) Unit() string {
+	switch s {
+	case SuperCapVoltage:
+		return "V"
+	case UVIndex:
+		return "index"
+	case RainRate:
+		return "tips/h"
+	case SolarRadiation:
+		return "W/m²"
+	case Temperature:
+		return "°F"
+	case WindGustSpeed:
+		return "mph"
+	case Humidity:
+		return "%"
+	case Rain:
+		return "tips"
+	default:
+		return ""
+	}
+}
+
+// Decode extracts this sensor's reading from a message's data bytes (CRC
+// and preamble already stripped). Each sensor has its own sentinel encoding
+// for a missing or invalid reading, in which case valid is false.
+func (s Sensor) Decode(data []byte) (value float64, valid bool) {
+	if len(data) < 6 {
+		return 0, false
+	}
+
+	// Most sensors pack a 10-bit value into the top of bytes 3 and 4.
+	raw10 := (int(data[3])<<8 | int(data[4])) >> 6
+
+	switch s {
+	case SuperCapVoltage:
+		if raw10 == 0x3FF {
+			return 0, false
+		}
+		return float64(raw10) / 100, true
+
+	case UVIndex:
+		if data[3] == 0xFF {
+			return 0, false
+		}
+		return float64(raw10) / 50, true
+
+	case SolarRadiation:
+		if data[3] == 0xFF {
+			return 0, false
+		}
+		return float64(raw10) * 1.757936, true
+
+	case Light:
+		if raw10 == 0x3FF {
+			return 0, false
+		}
+		return float64(raw10), true
+
+	case Temperature:
+		// Signed 12-bit value in tenths of a degree Fahrenheit.
+		if int(data[3])<<4|int(data[4])>>4 == 0xFFC {
+			return 0, false
+		}
+		return float64(int16(uint16(data[3])<<8|uint16(data[4]))>>4) / 10, true
+
+	case Humidity:
+		raw := int(data[4]>>4)<<8 | int(data[3])
+		if raw == 0 {
+			return 0, false
+		}
+		return float64(raw) / 10, true
+
+	case WindGustSpeed:
+		return float64(data[3]), true
+
+	case Rain:
+		// Free-running 7-bit bucket tip counter.
+		if data[3] == 0x80 {
+			return 0, false
+		}
+		return float64(data[3] & 0x7F), true
+
+	case RainRate:
+		// Time between the two most recent bucket tips. Bit 6 of byte 4
+		// selects between whole seconds (light rain) and sixteenths of a
+		// second (heavy rain). The all-ones value means no tips recently.
+		raw := int(data[4]&0x30)<<4 | int(data[3])
+		if raw == 0x3FF {
+			return 0, true
+		}
+		if raw == 0 {
+			return 0, false
+		}
+
+		seconds := float64(raw)
+		if data[4]&0x40 == 0 {
+			seconds /= 16
+		}
+		return 3600 / seconds, true
+	}
+
+	return 0, false
+}
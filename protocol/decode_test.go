@@ -0,0 +1,70 @@
+package protocol
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+var decodeTests = []struct {
+	Sensor Sensor
+	Data   []byte
+	Value  float64
+	Valid  bool
+}{
+	{Temperature, []byte{0x80, 0x00, 0x00, 0x2D, 0x50, 0x00}, 72.5, true},
+	{Temperature, []byte{0x80, 0x00, 0x00, 0xFF, 0x60, 0x00}, -1.0, true},
+	{Temperature, []byte{0x80, 0x00, 0x00, 0xFF, 0xC1, 0x00}, 0, false},
+	{Humidity, []byte{0xA0, 0x00, 0x00, 0x6A, 0x20, 0x00}, 61.8, true},
+	{Humidity, []byte{0xA0, 0x00, 0x00, 0x00, 0x00, 0x00}, 0, false},
+	{UVIndex, []byte{0x40, 0x00, 0x00, 0x19, 0x00, 0x00}, 2, true},
+	{UVIndex, []byte{0x40, 0x00, 0x00, 0xFF, 0xC5, 0x00}, 0, false},
+	{SolarRadiation, []byte{0x60, 0x00, 0x00, 0x19, 0x00, 0x00}, 175.7936, true},
+	{SolarRadiation, []byte{0x60, 0x00, 0x00, 0xFF, 0xC5, 0x00}, 0, false},
+	{SuperCapVoltage, []byte{0x20, 0x00, 0x00, 0x5D, 0x40, 0x00}, 3.73, true},
+	{SuperCapVoltage, []byte{0x20, 0x00, 0x00, 0xFF, 0xC0, 0x00}, 0, false},
+	{Light, []byte{0x70, 0x00, 0x00, 0x10, 0x80, 0x00}, 66, true},
+	{WindGustSpeed, []byte{0x90, 0x00, 0x00, 0x0C, 0x00, 0x00}, 12, true},
+	{Rain, []byte{0xE0, 0x00, 0x00, 0x8A, 0x01, 0x00}, 10, true},
+	{Rain, []byte{0xE0, 0x00, 0x00, 0x80, 0x01, 0x00}, 0, false},
+	{RainRate, []byte{0x50, 0x00, 0x00, 0xFF, 0x71, 0x00}, 0, true},
+	{RainRate, []byte{0x50, 0x00, 0x00, 0x90, 0x41, 0x00}, 25, true},
+	{RainRate, []byte{0x50, 0x00, 0x00, 0x90, 0x01, 0x00}, 400, true},
+}
+
+func TestDecode(t *testing.T) {
+	for _, test := range decodeTests {
+		value, valid := test.Sensor.Decode(test.Data)
+		if valid != test.Valid || math.Abs(value-test.Value) > 1e-9 {
+			t.Errorf("%s %02X: got %v %v, expected %v %v\n",
+				test.Sensor, test.Data, value, valid, test.Value, test.Valid,
+			)
+		}
+	}
+}
+
+func TestRepeater(t *testing.T) {
+	for r := NoRepeater; r <= RepeaterH; r++ {
+		if decoded := decodeRepeater(EncodeRepeater(r)); decoded != r {
+			t.Fatalf("expected repeater %q, got %q\n", r, decoded)
+		}
+		if r == NoRepeater {
+			continue
+		}
+		if parsed, err := ParseRepeater(strings.ToLower(r.String())); err != nil || parsed != r {
+			t.Fatalf("expected repeater %q, got %q %v\n", r, parsed, err)
+		}
+	}
+
+	// Bit errors in a direct packet's trailer, which the CRC doesn't cover,
+	// don't make it a repeated one.
+	for _, trailer := range [][]byte{{0xFE, 0xFF}, {0x7F, 0xFF}, {0xFF, 0xFE}, {0x02, 0xFE}} {
+		if decoded := decodeRepeater(trailer); decoded != NoRepeater {
+			t.Fatalf("expected trailer %02X direct, got %q\n", trailer, decoded)
+		}
+	}
+
+	if _, err := ParseRepeater("I"); err == nil {
+		t.Fatalf("expected error for repeater I\n")
+	}
+}
@@ -0,0 +1,67 @@
+/*
+   rtldavis, an rtl-sdr receiver for Davis Instruments weather stations.
+   Copyright (C) 2015  Douglas Hall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package protocol
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// jsonMessage is the JSON representation of a Message. Value is null if the
+// reading is invalid.
+type jsonMessage struct {
+	Time          time.Time `json:"time"`
+	ID            byte      `json:"id"`
+	BatteryLow    bool      `json:"battery_low"`
+	Repeater      string    `json:"repeater,omitempty"`
+	Sensor        string    `json:"sensor"`
+	Value         *float64  `json:"value"`
+	Unit          string    `json:"unit,omitempty"`
+	WindSpeed     byte      `json:"wind_speed"`
+	WindDirection byte      `json:"wind_direction"`
+	Raw           string    `json:"raw"`
+	ChannelIdx    int       `json:"channel"`
+	FreqError     int       `json:"freq_error"`
+	RSSI          float64   `json:"rssi"`
+	SNR           float64   `json:"snr"`
+}
+
+func (m Message) MarshalJSON() ([]byte, error) {
+	j := jsonMessage{
+		Time:          m.Time,
+		ID:            m.ID,
+		BatteryLow:    m.BatteryLow,
+		Repeater:      m.Repeater.String(),
+		Sensor:        m.Sensor.String(),
+		Unit:          m.Sensor.Unit(),
+		WindSpeed:     m.WindSpeed,
+		WindDirection: m.WindDirection,
+		Raw:           strings.ToUpper(hex.EncodeToString(m.Data)),
+		ChannelIdx:    m.ChannelIdx,
+		FreqError:     m.FreqError,
+		RSSI:          m.RSSI,
+		SNR:           m.SNR,
+	}
+	if m.Valid {
+		j.Value = &m.Value
+	}
+
+	return json.Marshal(j)
+}
@@ -0,0 +1,42 @@
+package protocol
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/bemasher/rtldavis/dsp"
+)
+
+func TestMarshalJSON(t *testing.T) {
+	msg := NewMessage(dsp.Packet{Data: []byte{0xCB, 0x89, 0x80, 0x05, 0x4A, 0x2D, 0x50, 0x00, 0x12, 0x34}})
+	msg.Time = time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)
+	msg.ChannelIdx = 19
+	msg.FreqError = -1234
+	msg.RSSI = -20.5
+	msg.SNR = 30.25
+
+	buf, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"time":"2015-06-01T12:00:00Z","id":0,"battery_low":false,"sensor":"Temperature","value":72.5,"unit":"°F","wind_speed":5,"wind_direction":74,"raw":"80054A2D50001234","channel":19,"freq_error":-1234,"rssi":-20.5,"snr":30.25}`
+	if string(buf) != expected {
+		t.Fatalf("got:\n%s\nexpected:\n%s\n", buf, expected)
+	}
+
+	msg.Valid = false
+	buf, err = json.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(buf, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if value, exists := decoded["value"]; !exists || value != nil {
+		t.Fatalf("invalid reading should have null value: %s\n", buf)
+	}
+}
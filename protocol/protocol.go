@@ -21,111 +21,211 @@ import (
 	"fmt"
 	"math"
 	"math/rand"
+	"strconv"
 	"time"
 
 	"github.com/bemasher/rtldavis/crc"
 	"github.com/bemasher/rtldavis/dsp"
 )
 
+// PayloadLength is the length of a packet's data and CRC, following the sync
+// word and followed by a trailer identifying repeated packets.
+const PayloadLength = 8
+
 func NewPacketConfig(symbolLength int) (cfg dsp.PacketConfig) {
+	// The sync word, payload and trailer.
 	return dsp.NewPacketConfig(
 		19200,
 		14,
 		16,
-		80,
+		(2+PayloadLength+TrailerLength)*8,
 		"1100101110001001",
 	)
 }
 
+// MaxTransmitters is the number of distinct transmitter IDs a Davis
+// receiver can listen to.
+const MaxTransmitters = 8
+
+// Transmitter holds the hopping state of a single transmitter.
+type Transmitter struct {
+	ID        int
+	DwellTime time.Duration
+
+	// Repeater is the repeater the transmitter is heard through, packets
+	// heard by any other path are ignored. Hop timing is learned from the
+	// packets heard, so follows the repeater's retransmissions.
+	Repeater Repeater
+
+	hopIdx int
+
+	currentFreqErr int
+	channelFreqErr map[int]int
+}
+
 type Parser struct {
 	dsp.Demodulator
 	crc.CRC
 
 	Cfg dsp.PacketConfig
 
-	ID        int
-	DwellTime time.Duration
+	Band         Band
+	Transmitters []*Transmitter
 
 	channelCount int
-	channels     []int
+	patternIdx   []int
 
-	hopIdx     int
-	hopPattern []int
+	// The hop the receiver is currently tuned to.
+	tuned Hop
 
-	currentFreqErr int
-	channelFreqErr map[int]int
+	// The number of packets heard at least CRCErrorSNR above the noise floor
+	// that failed their CRC.
+	CRCErrors int
 }
 
-func NewParser(symbolLength, id int) (p Parser) {
+// CRCErrorSNR is the signal to noise ratio in dB above which a packet failing
+// its CRC is counted as a CRC error. The sync word alone occasionally turns up
+// in noise, those aren't worth counting.
+const CRCErrorSNR = 6
+
+func NewParser(symbolLength int, band Band, ids ...int) (p Parser) {
 	p.Cfg = NewPacketConfig(symbolLength)
 	p.Demodulator = dsp.NewDemodulator(&p.Cfg)
 	p.CRC = crc.NewCRC("CCITT-16", 0, 0x1021, 0)
 
-	p.channels = []int{
-		902355835, 902857585, 903359336, 903861086, 904362837, 904864587,
-		905366338, 905868088, 906369839, 906871589, 907373340, 907875090,
-		908376841, 908878591, 909380342, 909882092, 910383843, 910885593,
-		911387344, 911889094, 912390845, 912892595, 913394346, 913896096,
-		914397847, 914899597, 915401347, 915903098, 916404848, 916906599,
-		917408349, 917910100, 918411850, 918913601, 919415351, 919917102,
-		920418852, 920920603, 921422353, 921924104, 922425854, 922927605,
-		923429355, 923931106, 924432856, 924934607, 925436357, 925938108,
-		926439858, 926941609, 927443359,
-	}
-	p.channelCount = len(p.channels)
+	p.Band = band
+	p.channelCount = len(p.Band.Channels)
 
-	p.hopIdx = rand.Intn(p.channelCount)
-	p.hopPattern = []int{
-		0, 19, 41, 25, 8, 47, 32, 13, 36, 22, 3, 29, 44, 16, 5, 27, 38, 10,
-		49, 21, 2, 30, 42, 14, 48, 7, 24, 34, 45, 1, 17, 39, 26, 9, 31, 50,
-		37, 12, 20, 33, 4, 43, 28, 15, 35, 6, 40, 11, 23, 46, 18,
+	// Map each channel back to its position in the hop pattern so a packet
+	// received on a channel tells us where its transmitter is in the pattern.
+	p.patternIdx = make([]int, p.channelCount)
+	for idx, channel := range p.Band.HopPattern {
+		p.patternIdx[channel] = idx
 	}
 
-	p.channelFreqErr = make(map[int]int)
+	for _, id := range ids {
+		t := &Transmitter{
+			ID:             id,
+			hopIdx:         rand.Intn(p.channelCount),
+			channelFreqErr: make(map[int]int),
+		}
 
-	p.ID = id
-	p.DwellTime = 2562500 * time.Microsecond
-	p.DwellTime += time.Duration(p.ID) * 62500 * time.Microsecond
+		t.DwellTime = p.Band.Dwell(t.ID)
+
+		p.Transmitters = append(p.Transmitters, t)
+	}
 
 	return
 }
 
+// Transmitter returns the state of the transmitter with the given ID, or nil
+// if the parser isn't tracking it.
+func (p *Parser) Transmitter(id int) *Transmitter {
+	for _, t := range p.Transmitters {
+		if t.ID == id {
+			return t
+		}
+	}
+	return nil
+}
+
+// FreqErrors are the frequency errors learned for a transmitter: the most
+// recent and the last seen on each channel.
+type FreqErrors struct {
+	Current  int         `json:"current"`
+	Channels map[int]int `json:"channels"`
+}
+
+// FreqErrors returns a copy of the frequency errors learned for the
+// transmitter.
+func (t *Transmitter) FreqErrors() FreqErrors {
+	e := FreqErrors{t.currentFreqErr, make(map[int]int, len(t.channelFreqErr))}
+	for channel, freqErr := range t.channelFreqErr {
+		e.Channels[channel] = freqErr
+	}
+	return e
+}
+
+// SetFreqErrors replaces the frequency errors learned for the transmitter,
+// e.g. with those saved by a previous run.
+func (t *Transmitter) SetFreqErrors(e FreqErrors) {
+	t.currentFreqErr = e.Current
+	t.channelFreqErr = make(map[int]int, len(e.Channels))
+	for channel, freqErr := range e.Channels {
+		t.channelFreqErr[channel] = freqErr
+	}
+}
+
+// HopIdx returns the transmitter's position in the hop pattern.
+func (t *Transmitter) HopIdx() int {
+	return t.hopIdx
+}
+
 type Hop struct {
+	ID          int
 	ChannelIdx  int
 	ChannelFreq int
 	FreqError   int
 }
 
 func (h Hop) String() string {
-	return fmt.Sprintf("{ChannelIdx:%2d ChannelFreq:%d FreqError:%d}",
-		h.ChannelIdx, h.ChannelFreq, h.FreqError,
+	return fmt.Sprintf("{ID:%d ChannelIdx:%2d ChannelFreq:%d FreqError:%d}",
+		h.ID, h.ChannelIdx, h.ChannelFreq, h.FreqError,
 	)
 }
 
-func (p *Parser) hop() (h Hop) {
-	h.ChannelIdx = p.hopPattern[p.hopIdx]
-	h.ChannelFreq = p.channels[h.ChannelIdx]
+func (p *Parser) hop(t *Transmitter) (h Hop) {
+	h.ID = t.ID
+	h.ChannelIdx = p.Band.HopPattern[t.hopIdx]
+	h.ChannelFreq = p.Band.Channels[h.ChannelIdx]
 
 	// If this channel has already been visited, use frequency error from last
 	// visit. Otherwise use frequency error from previous channel.
-	if freqErr, exists := p.channelFreqErr[p.hopPattern[p.hopIdx]]; exists {
-		p.currentFreqErr = freqErr
+	if freqErr, exists := t.channelFreqErr[h.ChannelIdx]; exists {
+		t.currentFreqErr = freqErr
 	}
-	h.FreqError = p.currentFreqErr
+	h.FreqError = t.currentFreqErr
 
 	return h
 }
 
-// Increment the pattern index and return the new channel's parameters.
-func (p *Parser) NextHop() Hop {
-	p.hopIdx = (p.hopIdx + 1) % p.channelCount
-	return p.hop()
+// Increment the transmitter's pattern index and return the new channel's
+// parameters.
+func (p *Parser) NextHop(t *Transmitter) Hop {
+	t.hopIdx = (t.hopIdx + 1) % p.channelCount
+	return p.hop(t)
+}
+
+// Randomize the transmitter's pattern index and return the new channel's
+// parameters.
+func (p *Parser) RandHop(t *Transmitter) Hop {
+	t.hopIdx = rand.Intn(p.channelCount)
+	return p.hop(t)
+}
+
+// SetHop moves the transmitter to the given position in the hop pattern,
+// wrapping around as necessary, and returns the new channel's parameters.
+func (p *Parser) SetHop(t *Transmitter, hopIdx int) Hop {
+	t.hopIdx = (hopIdx%p.channelCount + p.channelCount) % p.channelCount
+	return p.hop(t)
+}
+
+// CenterFreq returns the frequency to tune the receiver to for the given hop:
+// TuningOffset above the channel, corrected for the transmitter's frequency
+// error.
+func (p *Parser) CenterFreq(h Hop) int {
+	return h.ChannelFreq + TuningOffset + h.FreqError
+}
+
+// Tune records the hop the receiver has been tuned to. Packets passed to Parse
+// are assumed to have been received on this channel.
+func (p *Parser) Tune(h Hop) {
+	p.tuned = h
 }
 
-// Randomize the pattern index and return the new channel's parameters.
-func (p *Parser) RandHop() Hop {
-	p.hopIdx = rand.Intn(p.channelCount)
-	return p.hop()
+// Tuned returns the hop the receiver is currently tuned to.
+func (p *Parser) Tuned() Hop {
+	return p.tuned
 }
 
 // Given a list of packets, check them for validity and ignore duplicates,
@@ -146,8 +246,15 @@ func (p *Parser) Parse(pkts []dsp.Packet) (msgs []Message) {
 		}
 		seen[s] = true
 
-		// If the checksum fails, bail.
-		if p.Checksum(pkt.Data[2:]) != 0 {
+		// If the checksum fails, bail. The trailer isn't covered by it.
+		payload := pkt.Data[2:]
+		if len(payload) > PayloadLength {
+			payload = payload[:PayloadLength]
+		}
+		if p.Checksum(payload) != 0 {
+			if pkt.SNR >= CRCErrorSNR {
+				p.CRCErrors++
+			}
 			continue
 		}
 
@@ -167,13 +274,32 @@ func (p *Parser) Parse(pkts []dsp.Packet) (msgs []Message) {
 		// measured in radians.
 		freqError := -int(9600 + (mean*float64(p.Cfg.SampleRate))/(2*math.Pi))
 
-		// Set the current channel's frequency error.
-		p.channelFreqErr[p.hopPattern[p.hopIdx]] = p.currentFreqErr + freqError
+		msg := NewMessage(pkt)
+		msg.ChannelIdx = p.tuned.ChannelIdx
+
+		// The receiver was tuned with the tuned hop's frequency correction
+		// applied, so the transmitter's error on this channel is relative
+		// to that.
+		msg.FreqError = p.tuned.FreqError + freqError
+
+		// Only keep track of frequency error and hop state for transmitters
+		// we're listening for, by the path we're listening on. A repeater
+		// retransmits on its own schedule, following both would confuse the
+		// hop timing.
+		t := p.Transmitter(int(msg.ID))
+		if t == nil || t.Repeater != msg.Repeater {
+			msgs = append(msgs, msg)
+			continue
+		}
+
+		t.currentFreqErr = msg.FreqError
+		t.channelFreqErr[p.tuned.ChannelIdx] = t.currentFreqErr
 
-		// Update the current frequency error.
-		p.currentFreqErr += freqError
+		// The transmitter is on the channel we're tuned to, which may not be
+		// where we thought it was in the pattern.
+		t.hopIdx = p.patternIdx[p.tuned.ChannelIdx]
 
-		msgs = append(msgs, NewMessage(pkt))
+		msgs = append(msgs, msg)
 	}
 
 	return
@@ -185,24 +311,69 @@ type Message struct {
 	ID     byte
 	Sensor Sensor
 
+	// BatteryLow is set when the transmitter's battery is low.
+	BatteryLow bool
+
+	// Repeater is the repeater the packet was retransmitted by, if any, as
+	// identified by the trailer following the CRC.
+	Repeater Repeater
+	Trailer  []byte
+
 	WindSpeed     byte
 	WindDirection byte
+
+	// Value is the sensor reading scaled to the units given by Sensor.Unit.
+	// Valid is false when the transmitter reports the sensor as missing or
+	// the reading as invalid, in which case Value is zero.
+	Value float64
+	Valid bool
+
+	// Time the message was received, set by the receiver.
+	Time time.Time
+
+	// The channel the message was received on and the transmitter's
+	// frequency error on that channel in Hz.
+	ChannelIdx int
+	FreqError  int
 }
 
 func NewMessage(pkt dsp.Packet) (m Message) {
 	m.Idx = pkt.Idx
-	m.Data = make([]byte, len(pkt.Data)-2)
-	copy(m.Data, pkt.Data[2:])
+	m.RSSI = pkt.RSSI
+	m.SNR = pkt.SNR
+	// Data is the payload, the trailer only identifies the repeater.
+	payload := pkt.Data[2:]
+	if len(payload) > PayloadLength {
+		m.Trailer = append([]byte{}, payload[PayloadLength:]...)
+		m.Repeater = decodeRepeater(m.Trailer)
+		payload = payload[:PayloadLength]
+	}
+	m.Data = make([]byte, len(payload))
+	copy(m.Data, payload)
 
-	m.ID = m.Data[0] & 0xF
+	// The low three bits of the first byte are the transmitter's id, one
+	// less than the id set on its DIP switches, the next the battery flag.
+	m.ID = m.Data[0] & 0x7
+	m.BatteryLow = m.Data[0]&0x8 != 0
 	m.Sensor = Sensor(m.Data[0] >> 4)
 	m.WindSpeed = m.Data[1]
 	m.WindDirection = m.Data[2]
+	m.Value, m.Valid = m.Sensor.Decode(m.Data)
 	return m
 }
 
 func (m Message) String() string {
-	return fmt.Sprintf("{ID:%d Sensor:%s WindSpeed:%d WindDir:%d}", m.ID, m.Sensor, m.WindSpeed, m.WindDirection)
+	value := "invalid"
+	if m.Valid {
+		value = strconv.FormatFloat(m.Value, 'f', -1, 64)
+		if unit := m.Sensor.Unit(); unit != "" {
+			value += " " + unit
+		}
+	}
+
+	return fmt.Sprintf("{ID:%d Sensor:%s Value:%s WindSpeed:%d WindDir:%d}",
+		m.ID, m.Sensor, value, m.WindSpeed, m.WindDirection,
+	)
 }
 
 type Sensor byte
@@ -0,0 +1,82 @@
+/*
+   rtldavis, an rtl-sdr receiver for Davis Instruments weather stations.
+   Copyright (C) 2015  Douglas Hall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package protocol
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Repeater identifies the repeater a packet was retransmitted by, A through
+// H, or NoRepeater for a packet heard directly from its transmitter.
+type Repeater byte
+
+const (
+	NoRepeater Repeater = iota
+	RepeaterA
+	RepeaterB
+	RepeaterC
+	RepeaterD
+	RepeaterE
+	RepeaterF
+	RepeaterG
+	RepeaterH
+)
+
+func (r Repeater) String() string {
+	if r == NoRepeater {
+		return ""
+	}
+	return string(rune('A' + r - RepeaterA))
+}
+
+// ParseRepeater parses a repeater's letter, A through H.
+func ParseRepeater(s string) (Repeater, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	if len(s) != 1 || s[0] < 'A' || s[0] > 'H' {
+		return NoRepeater, fmt.Errorf("invalid repeater: %q, expected A-H", s)
+	}
+	return RepeaterA + Repeater(s[0]-'A'), nil
+}
+
+// TrailerLength is the length of the bytes following a packet's CRC.
+const TrailerLength = 2
+
+// decodeRepeater identifies the repeater from the bytes following a packet's
+// CRC. Transmitters leave them all ones. A repeater is taken to replace the
+// first with its id, 0 through 7, an assumption that hasn't been confirmed
+// against a capture of a repeater or documented by Davis. The CRC doesn't
+// cover the trailer, so anything else is taken to be a direct packet with
+// bit errors rather than dropped as some other path. The receiver logs
+// every trailer that isn't all ones verbosely so a recording replayed
+// through it can confirm the layout.
+func decodeRepeater(trailer []byte) Repeater {
+	if len(trailer) != TrailerLength || trailer[1] != 0xFF || trailer[0] > byte(RepeaterH-RepeaterA) {
+		return NoRepeater
+	}
+	return RepeaterA + Repeater(trailer[0])
+}
+
+// EncodeRepeater returns the bytes following a packet's CRC when sent by the
+// given repeater, or directly by its transmitter.
+func EncodeRepeater(r Repeater) []byte {
+	if r == NoRepeater {
+		return []byte{0xFF, 0xFF}
+	}
+	return []byte{byte(r - RepeaterA), 0xFF}
+}
@@ -0,0 +1,472 @@
+/*
+   rtldavis, an rtl-sdr receiver for Davis Instruments weather stations.
+   Copyright (C) 2015  Douglas Hall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+// Package receiver follows one or more Davis transmitters through their
+// hopping patterns and decodes the messages they send.
+package receiver
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+
+	"github.com/bemasher/rtldavis/dsp"
+	"github.com/bemasher/rtldavis/output"
+	"github.com/bemasher/rtldavis/protocol"
+	"github.com/bemasher/rtldavis/source"
+)
+
+// SymbolLength is the number of samples per symbol the receiver demodulates
+// with.
+const SymbolLength = 14
+
+// MessageBuffer is the number of messages buffered for readers of Messages.
+const MessageBuffer = 64
+
+// Option configures a Receiver.
+type Option func(*Receiver) error
+
+// WithSource sets the source samples are read from and tuned with.
+func WithSource(src source.Source) Option {
+	return func(r *Receiver) error {
+		r.src = src
+		return nil
+	}
+}
+
+// WithIDs sets the ids of the transmitters to listen for, defaults to 0.
+func WithIDs(ids ...int) Option {
+	return func(r *Receiver) error {
+		if len(ids) == 0 {
+			return errors.New("no ids given")
+		}
+		if len(ids) > protocol.MaxTransmitters {
+			return fmt.Errorf("too many ids, at most %d", protocol.MaxTransmitters)
+		}
+		seen := make(map[int]bool, len(ids))
+		for _, id := range ids {
+			if id < 0 || id >= protocol.MaxTransmitters {
+				return fmt.Errorf("id out of range [0,%d): %d", protocol.MaxTransmitters, id)
+			}
+			if seen[id] {
+				return fmt.Errorf("duplicate id: %d", id)
+			}
+			seen[id] = true
+		}
+		r.ids = ids
+		return nil
+	}
+}
+
+// WithRepeater listens for the transmitter with the given id through a
+// repeater rather than directly. The id must also be given to WithIDs.
+func WithRepeater(id int, repeater protocol.Repeater) Option {
+	return func(r *Receiver) error {
+		if repeater > protocol.RepeaterH {
+			return fmt.Errorf("invalid repeater: %d", repeater)
+		}
+		if r.repeaters == nil {
+			r.repeaters = make(map[int]protocol.Repeater)
+		}
+		r.repeaters[id] = repeater
+		return nil
+	}
+}
+
+// WithBand sets the frequency plan of the transmitters, defaults to
+// protocol.US.
+func WithBand(b protocol.Band) Option {
+	return func(r *Receiver) error {
+		r.band = b
+		return nil
+	}
+}
+
+// WithSinks adds sinks every decoded message is written to.
+func WithSinks(sinks ...output.Sink) Option {
+	return func(r *Receiver) error {
+		r.sinks = append(r.sinks, sinks...)
+		return nil
+	}
+}
+
+// WithSampleClock timestamps messages by the number of samples read since
+// start instead of the wall clock. Use it when replaying recordings, where
+// the samples are the only clock there is.
+func WithSampleClock(start time.Time) Option {
+	return func(r *Receiver) error {
+		r.sampleTime = true
+		r.start = start
+		return nil
+	}
+}
+
+// WithState restores synchronization state from the named file when run
+// starts, if it exists, and saves it there every interval and when Run
+// returns.
+func WithState(name string, interval time.Duration) Option {
+	return func(r *Receiver) error {
+		if interval <= 0 {
+			return fmt.Errorf("state interval must be positive: %s", interval)
+		}
+		r.stateFile = name
+		r.stateInterval = interval
+		return nil
+	}
+}
+
+// WithStatsLog logs the reception statistics of each transmitter every
+// interval.
+func WithStatsLog(interval time.Duration) Option {
+	return func(r *Receiver) error {
+		r.statsInterval = interval
+		return nil
+	}
+}
+
+// WithLogger sets the logger sink errors are logged to. Nothing is logged by
+// default.
+func WithLogger(l *log.Logger) Option {
+	return func(r *Receiver) error {
+		r.logger = l
+		return nil
+	}
+}
+
+// WithVerboseLogger sets the logger hops are logged to. Nothing is logged by
+// default.
+func WithVerboseLogger(l *log.Logger) Option {
+	return func(r *Receiver) error {
+		r.verbose = l
+		return nil
+	}
+}
+
+// Receiver reads samples from a source, decodes messages from the
+// transmitters it's listening for and retunes the source to follow them.
+type Receiver struct {
+	p protocol.Parser
+
+	src        source.Source
+	ids        []int
+	repeaters  map[int]protocol.Repeater
+	band       protocol.Band
+	sinks      output.Multi
+	sampleTime bool
+	start      time.Time
+	logger     *log.Logger
+	verbose    *log.Logger
+
+	stateFile     string
+	stateInterval time.Duration
+	statsInterval time.Duration
+
+	scheduler *Scheduler
+	stats     *collector
+	messages  chan protocol.Message
+
+	// Samples dropped by the source so far.
+	dropped int64
+}
+
+// New returns a Receiver configured by opts. A source is required.
+func New(opts ...Option) (*Receiver, error) {
+	r := &Receiver{
+		ids:      []int{0},
+		band:     protocol.US,
+		logger:   log.New(ioutil.Discard, "", 0),
+		verbose:  log.New(ioutil.Discard, "", 0),
+		messages: make(chan protocol.Message, MessageBuffer),
+		stats:    newCollector(time.Time{}),
+	}
+
+	for _, opt := range opts {
+		if err := opt(r); err != nil {
+			return nil, err
+		}
+	}
+
+	if r.src == nil {
+		return nil, errors.New("receiver: no source")
+	}
+
+	r.p = protocol.NewParser(SymbolLength, r.band, r.ids...)
+	for id, repeater := range r.repeaters {
+		t := r.p.Transmitter(id)
+		if t == nil {
+			return nil, fmt.Errorf("receiver: repeater %s given for id %d, which isn't being listened for", repeater, id)
+		}
+		t.Repeater = repeater
+	}
+
+	return r, nil
+}
+
+// Config returns the configuration of the demodulator.
+func (r *Receiver) Config() dsp.PacketConfig {
+	return r.p.Cfg
+}
+
+// Band returns the frequency plan the receiver is following.
+func (r *Receiver) Band() protocol.Band {
+	return r.p.Band
+}
+
+// Messages returns a channel of decoded messages, closed when Run returns.
+// Messages are dropped if the channel's buffer is full, a slow reader never
+// stalls the receiver.
+func (r *Receiver) Messages() <-chan protocol.Message {
+	return r.messages
+}
+
+// Run receives until the source is exhausted or ctx is done. Reaching the end
+// of the source isn't an error. Only one of Run or Scan may be called, once.
+func (r *Receiver) Run(ctx context.Context) error {
+	defer close(r.messages)
+
+	p := &r.p
+
+	// Hops are scheduled by sample time, packet arrival times are accurate to
+	// the sample regardless of when blocks are read.
+	start := r.start
+	if !r.sampleTime {
+		start = time.Now()
+	}
+	clock := &SampleClock{Start: start, SampleRate: p.Cfg.SampleRate}
+	r.scheduler = NewScheduler(p, clock)
+
+	if r.stateFile != "" {
+		r.loadState()
+		defer r.saveState()
+	}
+	lastSave := clock.Now()
+	lastStats := clock.Now()
+
+	r.stats.mu.Lock()
+	r.stats.stats.Since = start
+	r.stats.mu.Unlock()
+	r.scheduler.stats = r.stats
+
+	dups := newDuplicates(p.Cfg)
+
+	hop := p.Tuned()
+	r.verbose.Printf("Hop: %s\n", hop)
+	if err := r.src.SetCenterFreq(p.CenterFreq(hop)); err != nil {
+		return err
+	}
+
+	// Handle frequency hops concurrently since the callback will stall if we
+	// stop reading to hop. Wait for the last hop before returning so the
+	// source isn't retuned after Run returns.
+	nextHop := make(chan protocol.Hop, 1)
+	hopErr := make(chan error, 1)
+	hopDone := make(chan struct{})
+	defer func() {
+		close(nextHop)
+		<-hopDone
+	}()
+	go func() {
+		defer close(hopDone)
+		for hop := range nextHop {
+			r.verbose.Printf("Hop: %s\n", hop)
+			if err := r.src.SetCenterFreq(p.CenterFreq(hop)); err != nil {
+				hopErr <- err
+				return
+			}
+		}
+	}()
+
+	block := make([]byte, p.Cfg.BlockSize2)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-hopErr:
+			return err
+		default:
+		}
+
+		if err := r.read(block, clock); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return nil
+			}
+			return err
+		}
+
+		// The last sample of the demodulator's buffer is the last sample
+		// read.
+		bufferStart := clock.Samples() - int64(p.Cfg.BufferLength)
+
+		crcErrors := p.CRCErrors
+		msgs := p.Parse(p.Demodulate(block))
+		if n := p.CRCErrors - crcErrors; n > 0 {
+			tuned := p.Tuned()
+			r.stats.crcErrors(tuned.ID, tuned.ChannelIdx, n)
+		}
+
+		for _, msg := range msgs {
+			at := clock.At(bufferStart + int64(msg.Idx))
+			id := int(msg.ID)
+			if !bytes.Equal(msg.Trailer, protocol.EncodeRepeater(protocol.NoRepeater)) {
+				r.verbose.Printf("Trailer: %d %02X repeater %q\n", id, msg.Trailer, msg.Repeater)
+			}
+
+			// Packets are only followed by the path we're listening on. A
+			// repeater retransmits each packet some time after the
+			// transmitter sends it, so packets heard through it are offset
+			// from the transmitter's schedule. Hop timing is learned from
+			// the arrival of the packets followed, so the offset and any
+			// difference in period are absorbed like a transmitter's clock
+			// drift rather than modeled.
+			if t := r.scheduler.transmitter(id); t == nil || t.Repeater != msg.Repeater {
+				continue
+			}
+
+			if dups.seen(id, msg.Data, at) {
+				r.stats.duplicate(id, msg.ChannelIdx)
+				continue
+			}
+
+			r.scheduler.Received(id, at)
+			r.stats.received(id, msg.ChannelIdx, msg.FreqError)
+
+			msg.Time = at
+			if !r.sampleTime {
+				msg.Time = time.Now()
+			}
+			r.emit(msg)
+		}
+
+		if r.statsInterval > 0 && clock.Now().Sub(lastStats) >= r.statsInterval {
+			r.logStats()
+			lastStats = clock.Now()
+		}
+
+		if r.stateFile != "" && clock.Now().Sub(lastSave) >= r.stateInterval {
+			r.saveState()
+			lastSave = clock.Now()
+		}
+
+		if hop, retune := r.scheduler.Update(); retune {
+			r.stats.hop()
+			select {
+			case nextHop <- hop:
+			case err := <-hopErr:
+				return err
+			}
+		}
+	}
+}
+
+// read reads a block of samples and advances the clock past them and any
+// samples the source dropped before them, which took time to arrive all the
+// same.
+func (r *Receiver) read(block []byte, clock *SampleClock) error {
+	if _, err := io.ReadFull(r.src, block); err != nil {
+		return err
+	}
+
+	if d, ok := r.src.(source.Dropper); ok {
+		dropped := d.Dropped()
+		clock.Advance(int(dropped - r.dropped))
+		r.dropped = dropped
+	}
+	clock.Advance(len(block) >> 1)
+
+	return nil
+}
+
+// Stats returns the reception statistics since Run was called. It's safe to
+// call concurrently with Run.
+func (r *Receiver) Stats() Stats {
+	stats := r.stats.snapshot()
+	if o, ok := r.src.(source.Overrunner); ok {
+		stats.Overruns = o.Overruns()
+	}
+	return stats
+}
+
+// logStats logs the reception statistics of each transmitter.
+func (r *Receiver) logStats() {
+	stats := r.Stats()
+	for _, id := range stats.IDs() {
+		r.logger.Printf("Stats: %d %s\n", id, stats.Transmitters[id])
+	}
+}
+
+// loadState restores the scheduler from the state file, a missing file
+// isn't an error.
+func (r *Receiver) loadState() {
+	state, err := LoadState(r.stateFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			r.logger.Println(err)
+		}
+		return
+	}
+	r.scheduler.Restore(state)
+}
+
+// saveState writes the scheduler's state to the state file.
+func (r *Receiver) saveState() {
+	if err := r.scheduler.State().Save(r.stateFile); err != nil {
+		r.logger.Println(err)
+	}
+}
+
+// emit writes a decoded message to the sinks and the message channel.
+func (r *Receiver) emit(msg protocol.Message) {
+	if err := r.sinks.Write(msg); err != nil {
+		r.logger.Println(err)
+	}
+
+	select {
+	case r.messages <- msg:
+	default:
+	}
+}
+
+// duplicates spots packets found on both sides of a block boundary: the same
+// data from the same transmitter within a packet's length of the last.
+type duplicates struct {
+	window time.Duration
+	last   map[int]protocol.Message
+}
+
+func newDuplicates(cfg dsp.PacketConfig) *duplicates {
+	return &duplicates{
+		window: time.Duration(cfg.PacketLength) * time.Second / time.Duration(cfg.SampleRate),
+		last:   make(map[int]protocol.Message),
+	}
+}
+
+// seen reports whether data from transmitter id received at is a duplicate,
+// recording it as the last packet from id if not.
+func (d *duplicates) seen(id int, data []byte, at time.Time) bool {
+	if prev, ok := d.last[id]; ok && bytes.Equal(prev.Data, data) && at.Sub(prev.Time) < d.window {
+		return true
+	}
+	d.last[id] = protocol.Message{Packet: dsp.Packet{Data: data}, Time: at}
+	return false
+}
@@ -0,0 +1,341 @@
+package receiver
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bemasher/rtldavis/modulator"
+	"github.com/bemasher/rtldavis/protocol"
+)
+
+// fakeSource serves samples from memory and records retunes.
+type fakeSource struct {
+	io.Reader
+	tunes []int
+}
+
+func (f *fakeSource) SetCenterFreq(freq int) error {
+	f.tunes = append(f.tunes, freq)
+	return nil
+}
+
+func (f *fakeSource) Close() error {
+	return nil
+}
+
+// Temperature of 72.5°F from transmitter 0 with 5mph wind at 74.
+var temperature = []byte{0x80, 0x05, 0x4A, 0x2D, 0x50, 0x00}
+
+func TestRun(t *testing.T) {
+	m := modulator.New(protocol.NewPacketConfig(SymbolLength))
+	m.Noise = 0.02
+
+	var samples []byte
+	for n := 0; n < 3; n++ {
+		samples = append(samples, m.Silence(2500)...)
+		samples = append(samples, m.Packet(temperature)...)
+	}
+
+	// Packets are timestamped to the sample they arrived at.
+	fs := float64(protocol.NewPacketConfig(SymbolLength).SampleRate)
+	spacing := time.Duration(float64(len(samples)/6) / fs * float64(time.Second))
+	samples = append(samples, m.Silence(2500)...)
+
+	src := &fakeSource{Reader: bytes.NewReader(samples)}
+	start := time.Unix(0, 0).UTC()
+
+	dir, err := ioutil.TempDir("", "rtldavis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stateFile := filepath.Join(dir, "state")
+
+	r, err := New(WithSource(src), WithSampleClock(start), WithState(stateFile, time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	var msgs []protocol.Message
+	for msg := range r.Messages() {
+		msgs = append(msgs, msg)
+	}
+
+	if len(msgs) != 3 {
+		t.Fatalf("expected 3 messages, got %d\n", len(msgs))
+	}
+	for idx, msg := range msgs {
+		if msg.Sensor != protocol.Temperature || msg.Value != 72.5 {
+			t.Fatalf("bad decode: %s\n", msg)
+		}
+		if !msg.Time.After(start) || msg.Time.Sub(start) > time.Second {
+			t.Fatalf("expected time from sample clock, got %s\n", msg.Time)
+		}
+		if idx == 0 {
+			continue
+		}
+		if d := msg.Time.Sub(msgs[idx-1].Time) - spacing; d > 100*time.Microsecond || d < -100*time.Microsecond {
+			t.Fatalf("expected packets %s apart, got %s\n", spacing, msg.Time.Sub(msgs[idx-1].Time))
+		}
+	}
+
+	stats := r.Stats()
+	if counts := stats.Transmitters[0]; counts.Received != 3 || counts.Duplicates != 0 || counts.Reception() != 100 {
+		t.Fatalf("bad statistics: %s\n", counts)
+	}
+	if !stats.Since.Equal(start) {
+		t.Fatalf("expected statistics since %s, got %s\n", start, stats.Since)
+	}
+
+	// State is saved when Run returns.
+	if state, err := LoadState(stateFile); err != nil || len(state.Transmitters) != 1 || !state.Transmitters[0].Synced {
+		t.Fatalf("expected synchronized state to be saved, got %+v %v\n", state, err)
+	}
+
+	// The source is tuned to the first hop before reading.
+	if len(src.tunes) == 0 {
+		t.Fatalf("source was never tuned\n")
+	}
+}
+
+// droppingSource drops a stretch of samples the way a dongle does when it
+// isn't read fast enough.
+type droppingSource struct {
+	fakeSource
+
+	// Byte offset and length of the stretch dropped.
+	at, n int
+
+	read    int
+	dropped int64
+}
+
+func (d *droppingSource) Read(buf []byte) (int, error) {
+	if d.read == d.at && d.n > 0 {
+		io.CopyN(ioutil.Discard, d.Reader, int64(d.n))
+		d.dropped += int64(d.n >> 1)
+		d.n = 0
+	}
+	if d.read < d.at && d.read+len(buf) > d.at {
+		buf = buf[:d.at-d.read]
+	}
+
+	n, err := d.Reader.Read(buf)
+	d.read += n
+	return n, err
+}
+
+func (d *droppingSource) Dropped() int64 {
+	return d.dropped
+}
+
+func TestDroppedSamples(t *testing.T) {
+	cfg := protocol.NewPacketConfig(SymbolLength)
+	m := modulator.New(cfg)
+	m.Noise = 0.02
+
+	// Three packets a dwell time apart.
+	dwell := protocol.NewParser(SymbolLength, protocol.US, 0).Transmitters[0].DwellTime
+	period := int(dwell.Seconds() * float64(cfg.SampleRate))
+
+	var samples []byte
+	for n := 0; n < 3; n++ {
+		samples = append(samples, m.Silence(2500+n*period-len(samples)>>1)...)
+		samples = append(samples, m.Packet(temperature)...)
+	}
+	samples = append(samples, m.Silence(2500)...)
+
+	// A hundred blocks are dropped between the second and third packets.
+	at := (2500 + period*3/2) << 1
+	at -= at % cfg.BlockSize2
+	src := &droppingSource{
+		fakeSource: fakeSource{Reader: bytes.NewReader(samples)},
+		at:         at,
+		n:          100 * cfg.BlockSize2,
+	}
+
+	r, err := New(WithSource(src), WithSampleClock(time.Unix(0, 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	var msgs []protocol.Message
+	for msg := range r.Messages() {
+		msgs = append(msgs, msg)
+	}
+	if len(msgs) != 3 {
+		t.Fatalf("expected 3 messages, got %d\n", len(msgs))
+	}
+
+	// The samples dropped took time all the same.
+	if d := msgs[2].Time.Sub(msgs[1].Time) - dwell; d > 100*time.Microsecond || d < -100*time.Microsecond {
+		t.Fatalf("expected packets %s apart across the drop, got %s\n", dwell, msgs[2].Time.Sub(msgs[1].Time))
+	}
+
+	// So the next hop is predicted a dwell time after the last packet.
+	tx := r.scheduler.transmitter(0)
+	if d := tx.period - dwell; d > time.Millisecond || d < -time.Millisecond {
+		t.Fatalf("expected period near %s, got %s\n", dwell, tx.period)
+	}
+	if !tx.expected.Equal(msgs[2].Time.Add(tx.period)) {
+		t.Fatalf("expected next packet at %s, got %s\n", msgs[2].Time.Add(tx.period), tx.expected)
+	}
+}
+
+func TestRepeater(t *testing.T) {
+	m := modulator.New(protocol.NewPacketConfig(SymbolLength))
+	m.Noise = 0.02
+
+	// Each packet is heard directly and again through repeater B.
+	var samples []byte
+	for n := 0; n < 3; n++ {
+		samples = append(samples, m.Silence(2500)...)
+		samples = append(samples, m.Packet(temperature)...)
+		samples = append(samples, m.Silence(2500)...)
+		samples = append(samples, m.RepeatedPacket(temperature, protocol.RepeaterB)...)
+	}
+	samples = append(samples, m.Silence(2500)...)
+
+	src := &fakeSource{Reader: bytes.NewReader(samples)}
+	r, err := New(WithSource(src), WithSampleClock(time.Unix(0, 0)), WithRepeater(0, protocol.RepeaterB))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	n := 0
+	for msg := range r.Messages() {
+		if msg.Repeater != protocol.RepeaterB {
+			t.Fatalf("expected only messages through repeater B, got %q\n", msg.Repeater)
+		}
+		n++
+	}
+	if n != 3 {
+		t.Fatalf("expected 3 messages, got %d\n", n)
+	}
+
+	if _, err := New(WithSource(src), WithRepeater(1, protocol.RepeaterA)); err == nil {
+		t.Fatalf("expected error for repeater of an id not listened for\n")
+	}
+}
+
+func TestRunCanceled(t *testing.T) {
+	src := &fakeSource{Reader: bytes.NewReader(make([]byte, 1<<16))}
+
+	r, err := New(WithSource(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := r.Run(ctx); err != context.Canceled {
+		t.Fatalf("expected %v, got %v\n", context.Canceled, err)
+	}
+	if _, ok := <-r.Messages(); ok {
+		t.Fatalf("expected messages to be closed\n")
+	}
+}
+
+func TestNew(t *testing.T) {
+	if _, err := New(); err == nil {
+		t.Fatalf("expected error without a source\n")
+	}
+
+	src := &fakeSource{Reader: ioutil.NopCloser(nil)}
+	if _, err := New(WithSource(src), WithIDs(8)); err == nil {
+		t.Fatalf("expected error for id out of range\n")
+	}
+	if _, err := New(WithSource(src), WithIDs()); err == nil {
+		t.Fatalf("expected error without ids\n")
+	}
+	if _, err := New(WithSource(src), WithIDs(0, 1, 0)); err == nil {
+		t.Fatalf("expected error for duplicate ids\n")
+	}
+}
+
+func TestDuplicates(t *testing.T) {
+	cfg := protocol.NewPacketConfig(SymbolLength)
+	d := newDuplicates(cfg)
+	at := time.Unix(0, 0)
+
+	if d.seen(0, temperature, at) {
+		t.Fatalf("expected first packet not to be a duplicate\n")
+	}
+	if !d.seen(0, temperature, at.Add(time.Millisecond)) {
+		t.Fatalf("expected the same packet within a packet length to be a duplicate\n")
+	}
+	if d.seen(1, temperature, at.Add(time.Millisecond)) {
+		t.Fatalf("expected a packet from another transmitter not to be a duplicate\n")
+	}
+	if d.seen(0, temperature, at.Add(time.Second)) {
+		t.Fatalf("expected the same packet a second later not to be a duplicate\n")
+	}
+}
+
+func TestScan(t *testing.T) {
+	cfg := protocol.NewPacketConfig(SymbolLength)
+	m := modulator.New(cfg)
+	m.Noise = 0.02
+
+	temperature2 := []byte{0x82, 0x05, 0x4A, 0x2D, 0x50, 0x00}
+	humidity2 := []byte{0xA2, 0x05, 0x4A, 0x6A, 0x20, 0x00}
+	humidity5 := []byte{0xA5, 0x05, 0x4A, 0x6A, 0x20, 0x00}
+
+	var samples []byte
+	samples = append(samples, m.Silence(2500)...)
+	first := len(samples) >> 1
+	samples = append(samples, m.Packet(temperature2)...)
+	samples = append(samples, m.Silence(2500)...)
+	samples = append(samples, m.Packet(humidity5)...)
+
+	// Transmitter 2 is heard again one period later.
+	period := protocol.US.Dwell(2)
+	next := first + int(period.Seconds()*float64(cfg.SampleRate))
+	samples = append(samples, m.Silence(next-len(samples)>>1)...)
+	samples = append(samples, m.Packet(humidity2)...)
+	samples = append(samples, m.Silence(2500)...)
+
+	src := &fakeSource{Reader: bytes.NewReader(samples)}
+	r, err := New(WithSource(src), WithIDs(0), WithSampleClock(time.Unix(0, 0).UTC()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stations, err := r.Scan(context.Background(), time.Minute, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(stations) != 2 || stations[0].ID != 2 || stations[1].ID != 5 {
+		t.Fatalf("expected stations 2 and 5, got %+v\n", stations)
+	}
+
+	s := stations[0]
+	if s.Packets != 2 || len(s.Sensors) != 2 || s.Sensors[0] != protocol.Temperature || s.Sensors[1] != protocol.Humidity {
+		t.Fatalf("bad station: %+v\n", s)
+	}
+	if d := s.Period - period; d > time.Millisecond || d < -time.Millisecond {
+		t.Fatalf("expected period near %s, got %s\n", period, s.Period)
+	}
+	if stations[1].Period != 0 {
+		t.Fatalf("expected unknown period for station heard once, got %s\n", stations[1].Period)
+	}
+}
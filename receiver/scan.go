@@ -0,0 +1,187 @@
+/*
+   rtldavis, an rtl-sdr receiver for Davis Instruments weather stations.
+   Copyright (C) 2015  Douglas Hall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package receiver
+
+import (
+	"context"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/bemasher/rtldavis/protocol"
+)
+
+// Station summarizes the packets heard from a transmitter while scanning. A
+// transmitter heard both directly and through repeaters is a station for
+// each path.
+type Station struct {
+	ID       int
+	Repeater protocol.Repeater
+	Packets  int
+	Sensors  []protocol.Sensor
+
+	First, Last time.Time
+
+	// Period is the transmit period estimated from the time between
+	// packets, zero until two packets have been heard.
+	Period time.Duration
+
+	// Mean frequency error, signal strength and signal to noise ratio of
+	// the packets heard.
+	FreqError int
+	RSSI      float64
+	SNR       float64
+
+	freqErrSum int
+	rssiSum    float64
+	snrSum     float64
+}
+
+// add updates the station with a message heard at the given time.
+func (s *Station) add(msg protocol.Message, band protocol.Band) {
+	if s.Packets == 0 {
+		s.First = msg.Time
+	} else if elapsed := msg.Time.Sub(s.Last); elapsed > 0 {
+		// Any number of packets may have been sent on other channels since
+		// the last one heard.
+		dwell := band.Dwell(s.ID)
+		if n := (elapsed + dwell/2) / dwell; n > 0 {
+			s.Period = elapsed / n
+		}
+	}
+	s.Last = msg.Time
+
+	idx := sort.Search(len(s.Sensors), func(i int) bool { return s.Sensors[i] >= msg.Sensor })
+	if idx == len(s.Sensors) || s.Sensors[idx] != msg.Sensor {
+		s.Sensors = append(s.Sensors, 0)
+		copy(s.Sensors[idx+1:], s.Sensors[idx:])
+		s.Sensors[idx] = msg.Sensor
+	}
+
+	s.Packets++
+	s.freqErrSum += msg.FreqError
+	s.rssiSum += msg.RSSI
+	s.snrSum += msg.SNR
+	s.FreqError = s.freqErrSum / s.Packets
+	s.RSSI = s.rssiSum / float64(s.Packets)
+	s.SNR = s.snrSum / float64(s.Packets)
+}
+
+// Scan listens for packets from any transmitter instead of following the
+// configured ones. It camps on each channel of the hop pattern in turn for
+// channelTime, long enough for every transmitter to have visited the channel
+// if it's at least a full cycle of the pattern. Scan returns the stations
+// heard when duration has passed, the source is exhausted or ctx is done.
+// Decoded messages are written to the sinks and the message channel as they
+// arrive. The stations heard are returned even if there's an error.
+func (r *Receiver) Scan(ctx context.Context, channelTime, duration time.Duration) (stations []Station, err error) {
+	defer close(r.messages)
+
+	p := &r.p
+
+	start := r.start
+	if !r.sampleTime {
+		start = time.Now()
+	}
+	clock := &SampleClock{Start: start, SampleRate: p.Cfg.SampleRate}
+
+	type path struct {
+		id       int
+		repeater protocol.Repeater
+	}
+	heard := make(map[path]*Station)
+	defer func() {
+		stations = make([]Station, 0, len(heard))
+		for _, s := range heard {
+			stations = append(stations, *s)
+		}
+		sort.Slice(stations, func(i, j int) bool {
+			if stations[i].ID != stations[j].ID {
+				return stations[i].ID < stations[j].ID
+			}
+			return stations[i].Repeater < stations[j].Repeater
+		})
+	}()
+
+	var (
+		patternIdx int
+		retune     time.Time
+	)
+
+	dups := newDuplicates(p.Cfg)
+
+	block := make([]byte, p.Cfg.BlockSize2)
+	bufferStart := func() int64 { return clock.Samples() - int64(p.Cfg.BufferLength) }
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		default:
+		}
+
+		now := clock.Now()
+		if duration > 0 && now.Sub(start) >= duration {
+			return nil, nil
+		}
+
+		if !now.Before(retune) {
+			channel := p.Band.HopPattern[patternIdx%len(p.Band.HopPattern)]
+			hop := protocol.Hop{ChannelIdx: channel, ChannelFreq: p.Band.Channels[channel]}
+			patternIdx++
+			retune = now.Add(channelTime)
+
+			p.Tune(hop)
+			r.verbose.Printf("Scan: %s\n", hop)
+			if err := r.src.SetCenterFreq(p.CenterFreq(hop)); err != nil {
+				return nil, err
+			}
+		}
+
+		if err := r.read(block, clock); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return nil, nil
+			}
+			return nil, err
+		}
+
+		for _, msg := range p.Parse(p.Demodulate(block)) {
+			// Stations are timed by sample, messages are timestamped like
+			// they are by Run.
+			at := clock.At(bufferStart() + int64(msg.Idx))
+			msg.Time = at
+
+			if dups.seen(int(msg.ID), msg.Data, at) {
+				continue
+			}
+
+			key := path{int(msg.ID), msg.Repeater}
+			s, ok := heard[key]
+			if !ok {
+				s = &Station{ID: key.id, Repeater: key.repeater}
+				heard[key] = s
+			}
+			s.add(msg, p.Band)
+
+			if !r.sampleTime {
+				msg.Time = time.Now()
+			}
+			r.emit(msg)
+		}
+	}
+}
@@ -0,0 +1,316 @@
+/*
+   rtldavis, an rtl-sdr receiver for Davis Instruments weather stations.
+   Copyright (C) 2015  Douglas Hall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package receiver
+
+import (
+	"time"
+
+	"github.com/bemasher/rtldavis/protocol"
+)
+
+// Clock tells the scheduler what time it is.
+type Clock interface {
+	Now() time.Time
+}
+
+// WallClock is the time of day.
+type WallClock struct{}
+
+func (WallClock) Now() time.Time {
+	return time.Now()
+}
+
+// SampleClock measures time by the number of samples read since Start.
+type SampleClock struct {
+	Start      time.Time
+	SampleRate int
+
+	samples int64
+}
+
+// Advance moves the clock forward by n samples.
+func (c *SampleClock) Advance(n int) {
+	c.samples += int64(n)
+}
+
+// Samples returns the number of samples read since Start.
+func (c *SampleClock) Samples() int64 {
+	return c.samples
+}
+
+// At returns the time of the given sample.
+func (c *SampleClock) At(sample int64) time.Time {
+	return c.Start.Add(time.Duration(sample * int64(time.Second) / int64(c.SampleRate)))
+}
+
+func (c *SampleClock) Now() time.Time {
+	return c.At(c.samples)
+}
+
+const (
+	// The receiver is tuned to a synchronized transmitter's next channel
+	// period/lead before the packet is expected.
+	lead = 8
+	// A packet is missed if it hasn't arrived period/margin after it was
+	// expected.
+	margin = 8
+	// Each observed period moves the estimate 1/smoothing of the way
+	// towards it.
+	smoothing = 4
+	// Observed periods further than dwell/tolerance from the nominal dwell
+	// time are discarded.
+	tolerance = 20
+)
+
+// transmitter tracks the timing and missed-packet state of a transmitter
+// we're listening for.
+type transmitter struct {
+	*protocol.Transmitter
+
+	hop       protocol.Hop
+	missCount int
+
+	// When unsynchronized, the end of the wait for a packet on the current
+	// channel. Otherwise the time after which the next packet is missed.
+	deadline time.Time
+
+	// The time the next packet is expected and the estimated transmit
+	// period.
+	expected time.Time
+	period   time.Duration
+
+	// Whether the next packet is due, and if so whether the tuner was on
+	// the transmitter's channel when it was. Packets expected while the
+	// tuner was following another transmitter aren't counted as missed.
+	due, listened bool
+
+	// The time of the last packet received.
+	last time.Time
+}
+
+// synced reports whether we're following the transmitter's hop pattern.
+func (t *transmitter) synced() bool {
+	return t.missCount < 3
+}
+
+// Scheduler decides which channel to listen on. It's driven by two events:
+// a packet being received from a transmitter and the passing of time, and
+// produces the hops the receiver should retune to.
+type Scheduler struct {
+	clock        Clock
+	p            *protocol.Parser
+	transmitters []*transmitter
+	stats        *collector
+}
+
+// NewScheduler returns a scheduler for the parser's transmitters and tunes
+// the parser to the first of them.
+func NewScheduler(p *protocol.Parser, clock Clock) *Scheduler {
+	s := &Scheduler{
+		clock:        clock,
+		p:            p,
+		transmitters: make([]*transmitter, len(p.Transmitters)),
+	}
+
+	now := clock.Now()
+
+	// Set the deadline for one full rotation of the pattern + 1. Some
+	// channels may have enough frequency error that they won't receive until
+	// we've seen at least one message and set the frequency correction. We
+	// set missCount to 3 so that when the deadline expires we pick another
+	// random channel and wait on that channel instead of hopping like we
+	// missed one.
+	for idx, t := range p.Transmitters {
+		s.transmitters[idx] = &transmitter{
+			Transmitter: t,
+			hop:         p.RandHop(t),
+			missCount:   3,
+			deadline:    now.Add(p.Band.SyncWait(t.ID)),
+			period:      t.DwellTime,
+		}
+	}
+
+	p.Tune(s.transmitters[0].hop)
+
+	return s
+}
+
+// transmitter returns the state of the transmitter with the given id or nil
+// if we aren't listening for it.
+func (s *Scheduler) transmitter(id int) *transmitter {
+	for _, t := range s.transmitters {
+		if t.ID == id {
+			return t
+		}
+	}
+	return nil
+}
+
+// Synced reports whether the transmitter with the given id is being
+// followed through its hop pattern.
+func (s *Scheduler) Synced(id int) bool {
+	t := s.transmitter(id)
+	return t != nil && t.synced()
+}
+
+// Received records a packet received at the given time from the transmitter
+// with the given id. It reports false if we aren't listening for the
+// transmitter.
+func (s *Scheduler) Received(id int, at time.Time) bool {
+	t := s.transmitter(id)
+	if t == nil {
+		return false
+	}
+
+	t.observe(at)
+
+	if !t.synced() {
+		s.stats.resync(t.ID)
+	}
+
+	// Reset the missed packet counter.
+	t.missCount = 0
+
+	// The next packet is due one period from now.
+	t.expected = at.Add(t.period)
+	t.deadline = t.expected.Add(t.period / margin)
+	t.due = false
+
+	// Follow the transmitter to the next channel.
+	t.hop = s.p.NextHop(t.Transmitter)
+
+	return true
+}
+
+// observe refines the transmit period estimate from the time since the last
+// packet. Any number of packets may have been missed in between.
+func (t *transmitter) observe(at time.Time) {
+	last := t.last
+	t.last = at
+	if last.IsZero() {
+		return
+	}
+
+	elapsed := at.Sub(last)
+	n := (elapsed + t.period/2) / t.period
+	if n < 1 {
+		return
+	}
+
+	observed := elapsed / n
+	if diff := observed - t.DwellTime; diff > t.DwellTime/tolerance || -diff > t.DwellTime/tolerance {
+		return
+	}
+
+	t.period += (observed - t.period) / smoothing
+}
+
+// Update handles expired deadlines and picks the channel to listen on. If it
+// differs from the one the parser is tuned to the parser is retuned and the
+// new hop is returned with retune set.
+func (s *Scheduler) Update() (hop protocol.Hop, retune bool) {
+	now := s.clock.Now()
+
+	// The parser has been tuned to the same hop since the last update.
+	tuned := s.p.Tuned()
+	for _, t := range s.transmitters {
+		if t.synced() && !t.due && !now.Before(t.expected) {
+			t.due = true
+			t.listened = tuned.ChannelIdx == t.hop.ChannelIdx
+		}
+	}
+
+	for _, t := range s.transmitters {
+		if now.Before(t.deadline) {
+			continue
+		}
+
+		// If the deadline has expired one of two things has happened:
+		//     1: We've missed a message.
+		//     2: We've waited for sync and nothing has happened for a
+		//        full cycle of the pattern.
+		if t.synced() && t.listened {
+			s.stats.missed(t.ID, t.hop.ChannelIdx)
+		}
+		t.missCount++
+
+		if t.missCount == 3 {
+			s.stats.syncLost(t.ID)
+		}
+
+		if !t.synced() {
+			// We've missed three packets in a row, hop to a random channel
+			// and wait for a full hopping cycle.
+			t.hop = s.p.RandHop(t.Transmitter)
+			t.deadline = now.Add(s.p.Band.SyncWait(t.ID))
+		} else {
+			// We've missed fewer than three packets in a row, the
+			// transmitter has moved on to the next channel in the pattern
+			// regardless.
+			t.hop = s.p.NextHop(t.Transmitter)
+			t.expected = t.expected.Add(t.period)
+			t.deadline = t.expected.Add(t.period / margin)
+			t.due = false
+		}
+	}
+
+	next := s.pick(now)
+	if next.hop == s.p.Tuned() {
+		return next.hop, false
+	}
+
+	s.p.Tune(next.hop)
+	return next.hop, true
+}
+
+// pick chooses the transmitter the tuner should listen for. A synchronized
+// transmitter takes priority once it's within the lead time of its next
+// packet, the one due soonest if there are several. Otherwise camp on the
+// channel of an unsynchronized transmitter so it has a chance to be found.
+func (s *Scheduler) pick(now time.Time) (next *transmitter) {
+	for _, t := range s.transmitters {
+		if !t.synced() || t.expected.Sub(now) > t.period/lead {
+			continue
+		}
+
+		if next == nil || t.expected.Before(next.expected) {
+			next = t
+		}
+	}
+	if next != nil {
+		return next
+	}
+
+	for _, t := range s.transmitters {
+		if !t.synced() && (next == nil || t.deadline.Before(next.deadline)) {
+			next = t
+		}
+	}
+	if next != nil {
+		return next
+	}
+
+	// Everything is synchronized and nothing is due yet, get ahead of the
+	// next transmitter.
+	for _, t := range s.transmitters {
+		if next == nil || t.expected.Before(next.expected) {
+			next = t
+		}
+	}
+	return next
+}
@@ -0,0 +1,262 @@
+package receiver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bemasher/rtldavis/protocol"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+// step advances the clock by d in 10ms increments, updating the scheduler at
+// each and returning the hops it retuned to.
+func step(s *Scheduler, c *fakeClock, d time.Duration) (hops []protocol.Hop) {
+	for end := c.now.Add(d); c.now.Before(end); {
+		c.now = c.now.Add(10 * time.Millisecond)
+		if hop, retune := s.Update(); retune {
+			hops = append(hops, hop)
+		}
+	}
+	return hops
+}
+
+// nextChannel returns the channel following channel in the band's pattern.
+func nextChannel(b protocol.Band, channel int) int {
+	for idx, ch := range b.HopPattern {
+		if ch == channel {
+			return b.HopPattern[(idx+1)%len(b.HopPattern)]
+		}
+	}
+	return -1
+}
+
+func newTestScheduler(ids ...int) (*Scheduler, *protocol.Parser, *fakeClock) {
+	p := protocol.NewParser(14, protocol.US, ids...)
+	c := &fakeClock{time.Unix(0, 0).UTC()}
+	return NewScheduler(&p, c), &p, c
+}
+
+func TestSchedulerLostPackets(t *testing.T) {
+	s, p, c := newTestScheduler(0)
+	s.stats = newCollector(c.now)
+	dwell := p.Band.Dwell(0)
+
+	if s.Synced(0) {
+		t.Fatalf("expected unsynchronized at start\n")
+	}
+
+	// Nothing happens until a full cycle of the pattern has passed.
+	if hops := step(s, c, dwell); len(hops) != 0 {
+		t.Fatalf("expected no hops while waiting for sync, got %v\n", hops)
+	}
+
+	channel := p.Tuned().ChannelIdx
+	if !s.Received(0, c.now) {
+		t.Fatalf("expected transmitter 0 to be tracked\n")
+	}
+	if !s.Synced(0) {
+		t.Fatalf("expected synchronized after a packet\n")
+	}
+
+	hop, retune := s.Update()
+	if !retune || hop.ChannelIdx != nextChannel(p.Band, channel) {
+		t.Fatalf("expected retune to channel %d, got %v %v\n", nextChannel(p.Band, channel), hop, retune)
+	}
+
+	// The first missed packet is noticed a margin after it was expected,
+	// following ones each dwell time after that.
+	for missed := 1; missed < 3; missed++ {
+		channel = p.Tuned().ChannelIdx
+
+		d := dwell
+		if missed == 1 {
+			d += dwell/margin + 10*time.Millisecond
+		}
+
+		hops := step(s, c, d)
+		if len(hops) != 1 || hops[0].ChannelIdx != nextChannel(p.Band, channel) {
+			t.Fatalf("missed %d: expected hop to channel %d, got %v\n", missed, nextChannel(p.Band, channel), hops)
+		}
+		if !s.Synced(0) {
+			t.Fatalf("missed %d: expected still synchronized\n", missed)
+		}
+	}
+
+	// The third miss loses sync.
+	step(s, c, dwell)
+	if s.Synced(0) {
+		t.Fatalf("expected unsynchronized after three missed packets\n")
+	}
+
+	// And we wait a full cycle on a random channel.
+	if hops := step(s, c, p.Band.SyncWait(0)-50*time.Millisecond); len(hops) != 0 {
+		t.Fatalf("expected no hops while waiting for sync, got %v\n", hops)
+	}
+
+	if s.Received(1, c.now) {
+		t.Fatalf("expected transmitter 1 to be untracked\n")
+	}
+
+	counts := s.stats.snapshot().Transmitters[0]
+	if counts.Missed != 3 || counts.Resyncs != 1 || counts.SyncLost != 1 || counts.Reception() != 0 {
+		t.Fatalf("bad statistics: %s\n", counts)
+	}
+}
+
+func TestSchedulerDrift(t *testing.T) {
+	s, p, c := newTestScheduler(3)
+
+	// The transmitter's clock runs 1% slow.
+	period := p.Band.Dwell(3) * 101 / 100
+
+	s.Received(3, c.now)
+	s.Update()
+
+	for n := 0; n < 50; n++ {
+		channel := p.Tuned().ChannelIdx
+
+		if hops := step(s, c, period); len(hops) != 0 {
+			t.Fatalf("packet %d: expected no hops before the packet, got %v\n", n, hops)
+		}
+
+		s.Received(3, c.now)
+		hop, retune := s.Update()
+		if !retune || hop.ChannelIdx != nextChannel(p.Band, channel) {
+			t.Fatalf("packet %d: expected hop to channel %d, got %v\n", n, nextChannel(p.Band, channel), hop)
+		}
+	}
+
+	if estimate := s.transmitter(3).period; estimate-period > 20*time.Millisecond || period-estimate > 20*time.Millisecond {
+		t.Fatalf("expected period near %s, got %s\n", period, estimate)
+	}
+
+	// Missed packets are predicted from the estimated period, so the tuner
+	// is on the right channel when the transmitter is heard again.
+	channel := p.Tuned().ChannelIdx
+	hops := step(s, c, 3*period)
+	if len(hops) != 2 {
+		t.Fatalf("expected 2 hops for missed packets, got %v\n", hops)
+	}
+	channel = nextChannel(p.Band, nextChannel(p.Band, channel))
+	if p.Tuned().ChannelIdx != channel {
+		t.Fatalf("expected to be tuned to channel %d, got %d\n", channel, p.Tuned().ChannelIdx)
+	}
+	if !s.Received(3, c.now) || !s.Synced(3) {
+		t.Fatalf("expected synchronized\n")
+	}
+}
+
+func TestSchedulerResync(t *testing.T) {
+	s, p, c := newTestScheduler(0)
+	dwell := p.Band.Dwell(0)
+
+	s.Received(0, c.now)
+	s.Update()
+
+	// Lose sync.
+	step(s, c, 4*dwell)
+	if s.Synced(0) {
+		t.Fatalf("expected unsynchronized\n")
+	}
+
+	// A packet heard while camped on a random channel puts us back in sync.
+	step(s, c, dwell)
+	channel := p.Tuned().ChannelIdx
+	s.Received(0, c.now)
+	if !s.Synced(0) {
+		t.Fatalf("expected synchronized\n")
+	}
+	if hop, retune := s.Update(); !retune || hop.ChannelIdx != nextChannel(p.Band, channel) {
+		t.Fatalf("expected hop to channel %d, got %v\n", nextChannel(p.Band, channel), hop)
+	}
+}
+
+func TestSchedulerPriority(t *testing.T) {
+	s, p, c := newTestScheduler(0, 1)
+
+	// Transmitter 1 is heard first, then transmitter 0 a second later.
+	tuned := p.Tuned()
+	s.Received(1, c.now)
+	c.now = c.now.Add(time.Second)
+	s.Received(0, c.now)
+
+	// Transmitter 1 is due first so the tuner follows it.
+	if hop, _ := s.Update(); hop.ID != 1 {
+		t.Fatalf("expected to follow transmitter 1, got %v (was %v)\n", hop, tuned)
+	}
+
+	// Once transmitter 1 has been heard again transmitter 0 is due.
+	step(s, c, p.Band.Dwell(1)-time.Second)
+	s.Received(1, c.now)
+	if hop, _ := s.Update(); hop.ID != 0 {
+		t.Fatalf("expected to follow transmitter 0, got %v\n", hop)
+	}
+}
+
+func TestSchedulerMissedWhileAway(t *testing.T) {
+	s, p, c := newTestScheduler(0, 1)
+	s.stats = newCollector(c.now)
+
+	// Both are heard together so their next packets are due together, and
+	// the tuner follows transmitter 0 which is due first.
+	s.Received(1, c.now)
+	s.Received(0, c.now)
+	s.Update()
+	same := s.transmitter(0).hop.ChannelIdx == s.transmitter(1).hop.ChannelIdx
+
+	// Neither arrives. Transmitter 1's packet was expected while the tuner
+	// was on transmitter 0's channel, so it can't have been missed unless
+	// they were on the same channel.
+	step(s, c, p.Band.Dwell(1)+p.Band.Dwell(1)/margin)
+
+	stats := s.stats.snapshot()
+	if counts := stats.Transmitters[0]; counts.Missed != 1 {
+		t.Fatalf("expected transmitter 0 to miss 1 packet: %s\n", counts)
+	}
+	if counts := stats.Transmitters[1]; counts.Missed != 0 && !same {
+		t.Fatalf("expected transmitter 1 to miss none while away: %s\n", counts)
+	}
+}
+
+func TestSchedulerRepeater(t *testing.T) {
+	p := protocol.NewParser(14, protocol.US, 2)
+	p.Transmitters[0].Repeater = protocol.RepeaterA
+	c := &fakeClock{time.Unix(0, 0).UTC()}
+	s := NewScheduler(&p, c)
+	s.stats = newCollector(c.now)
+	dwell := p.Band.Dwell(2)
+
+	// The repeater retransmits each packet after a delay that varies from
+	// packet to packet, offsetting it from the transmitter's schedule.
+	delays := []time.Duration{120 * time.Millisecond, 150 * time.Millisecond, 90 * time.Millisecond}
+	sent := c.now
+	c.now = sent.Add(delays[0])
+	s.Received(2, c.now)
+	s.Update()
+
+	for n := 1; n < 30; n++ {
+		channel := p.Tuned().ChannelIdx
+		sent = sent.Add(dwell)
+
+		if hops := step(s, c, sent.Add(delays[n%len(delays)]).Sub(c.now)); len(hops) != 0 {
+			t.Fatalf("packet %d: expected no hops before the packet, got %v\n", n, hops)
+		}
+
+		s.Received(2, c.now)
+		hop, retune := s.Update()
+		if !retune || hop.ChannelIdx != nextChannel(p.Band, channel) {
+			t.Fatalf("packet %d: expected hop to channel %d, got %v\n", n, nextChannel(p.Band, channel), hop)
+		}
+	}
+
+	if counts := s.stats.snapshot().Transmitters[2]; counts.Missed != 0 || counts.Resyncs != 1 {
+		t.Fatalf("bad statistics: %s\n", counts)
+	}
+}
@@ -0,0 +1,165 @@
+/*
+   rtldavis, an rtl-sdr receiver for Davis Instruments weather stations.
+   Copyright (C) 2015  Douglas Hall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package receiver
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/bemasher/rtldavis/protocol"
+)
+
+// MaxSyncAge is how old saved state may be before the hop timing in it is no
+// longer trusted. Learned frequency errors are restored regardless of age.
+const MaxSyncAge = 15 * time.Minute
+
+// State is the synchronization state of the transmitters a receiver is
+// following, saved so a restarted receiver can resume without waiting to
+// resynchronize and relearning frequency errors.
+type State struct {
+	Time         time.Time          `json:"time"`
+	Band         string             `json:"band"`
+	Transmitters []TransmitterState `json:"transmitters"`
+}
+
+// TransmitterState is the saved state of a single transmitter.
+type TransmitterState struct {
+	ID     int  `json:"id"`
+	Synced bool `json:"synced"`
+
+	// Position in the hop pattern of the channel the next packet is
+	// expected on, and when.
+	HopIdx   int       `json:"hop_idx"`
+	Expected time.Time `json:"expected"`
+
+	Period time.Duration `json:"period"`
+	Last   time.Time     `json:"last"`
+
+	FreqErrors protocol.FreqErrors `json:"freq_error"`
+}
+
+// State returns the synchronization state of the scheduler's transmitters.
+func (s *Scheduler) State() State {
+	state := State{
+		Time:         s.clock.Now(),
+		Band:         s.p.Band.Name,
+		Transmitters: make([]TransmitterState, len(s.transmitters)),
+	}
+
+	for idx, t := range s.transmitters {
+		state.Transmitters[idx] = TransmitterState{
+			ID:         t.ID,
+			Synced:     t.synced(),
+			HopIdx:     t.HopIdx(),
+			Expected:   t.expected,
+			Period:     t.period,
+			Last:       t.last,
+			FreqErrors: t.FreqErrors(),
+		}
+	}
+
+	return state
+}
+
+// Restore resumes from saved state. Frequency errors are always restored.
+// Transmitters that were synchronized when the state was saved no more than
+// MaxSyncAge ago are followed from where they're expected to be now,
+// assuming they've kept transmitting in the meantime.
+func (s *Scheduler) Restore(state State) {
+	if state.Band != s.p.Band.Name {
+		return
+	}
+
+	now := s.clock.Now()
+	fresh := !now.Before(state.Time) && now.Sub(state.Time) <= MaxSyncAge
+
+	for _, ts := range state.Transmitters {
+		t := s.transmitter(ts.ID)
+		if t == nil {
+			continue
+		}
+
+		t.SetFreqErrors(ts.FreqErrors)
+		t.hop = s.p.SetHop(t.Transmitter, t.HopIdx())
+
+		if !fresh || !ts.Synced {
+			continue
+		}
+
+		period := ts.Period
+		if diff := period - t.DwellTime; diff > t.DwellTime/tolerance || -diff > t.DwellTime/tolerance {
+			period = t.DwellTime
+		}
+
+		// Skip the packets sent while we weren't listening.
+		expected, hopIdx := ts.Expected, ts.HopIdx
+		if late := now.Sub(expected.Add(period / margin)); late >= 0 {
+			skipped := late/period + 1
+			expected = expected.Add(skipped * period)
+			hopIdx += int(skipped)
+		}
+
+		t.hop = s.p.SetHop(t.Transmitter, hopIdx)
+		t.missCount = 0
+		t.period = period
+		t.last = ts.Last
+		t.expected = expected
+		t.deadline = expected.Add(period / margin)
+	}
+
+	s.p.Tune(s.pick(now).hop)
+}
+
+// LoadState reads state saved by Save.
+func LoadState(name string) (state State, err error) {
+	buf, err := ioutil.ReadFile(name)
+	if err != nil {
+		return state, err
+	}
+	err = json.Unmarshal(buf, &state)
+	return state, err
+}
+
+// Save writes the state to the named file. The file is replaced atomically
+// so a crash while saving doesn't lose the previous state.
+func (state State) Save(name string) error {
+	buf, err := json.MarshalIndent(state, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(name), filepath.Base(name)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmp.Write(buf); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), name)
+}
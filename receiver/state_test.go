@@ -0,0 +1,106 @@
+package receiver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/bemasher/rtldavis/protocol"
+)
+
+// synchronized returns a scheduler that has heard several packets from
+// transmitter 0 on channels learned to be 1kHz off.
+func synchronized() (*Scheduler, *protocol.Parser, *fakeClock) {
+	s, p, c := newTestScheduler(0)
+	p.Transmitters[0].SetFreqErrors(protocol.FreqErrors{Current: 1000, Channels: map[int]int{0: 1000}})
+
+	for n := 0; n < 4; n++ {
+		s.Received(0, c.now)
+		s.Update()
+		step(s, c, p.Band.Dwell(0))
+	}
+	s.Received(0, c.now)
+	s.Update()
+
+	return s, p, c
+}
+
+func TestRestore(t *testing.T) {
+	s, p, c := synchronized()
+	state := s.State()
+	expected := s.transmitter(0)
+
+	// Restart ten and a half periods later.
+	later := c.now.Add(expected.period*10 + expected.period/2)
+	r, rp, _ := newTestScheduler(0)
+	r.clock = &fakeClock{later}
+	r.Restore(state)
+
+	if !r.Synced(0) {
+		t.Fatalf("expected synchronized after restore\n")
+	}
+
+	hopIdx := (p.Transmitters[0].HopIdx() + 10) % len(p.Band.HopPattern)
+	if tuned := rp.Tuned(); tuned.ChannelIdx != p.Band.HopPattern[hopIdx] || tuned.FreqError != 1000 {
+		t.Fatalf("expected to be tuned to channel %d with 1kHz error, got %v\n", p.Band.HopPattern[hopIdx], tuned)
+	}
+
+	got := r.transmitter(0)
+	if want := expected.expected.Add(10 * expected.period); !got.expected.Equal(want) {
+		t.Fatalf("expected next packet at %s, got %s\n", want, got.expected)
+	}
+}
+
+func TestRestoreStale(t *testing.T) {
+	s, _, c := synchronized()
+	state := s.State()
+
+	r, rp, _ := newTestScheduler(0)
+	r.clock = &fakeClock{c.now.Add(MaxSyncAge + time.Second)}
+	r.Restore(state)
+
+	if r.Synced(0) {
+		t.Fatalf("expected stale state to need resynchronization\n")
+	}
+	if e := rp.Transmitters[0].FreqErrors(); e.Current != 1000 {
+		t.Fatalf("expected frequency errors to be restored, got %+v\n", e)
+	}
+
+	// State from another band is ignored entirely.
+	state.Band = protocol.EU.Name
+	r, rp, _ = newTestScheduler(0)
+	r.Restore(state)
+	if e := rp.Transmitters[0].FreqErrors(); e.Current != 0 {
+		t.Fatalf("expected state from another band to be ignored, got %+v\n", e)
+	}
+}
+
+func TestSaveLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rtldavis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, _, _ := synchronized()
+	state := s.State()
+
+	name := filepath.Join(dir, "state")
+	if err := state.Save(name); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := LoadState(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Monotonic clock readings don't survive serialization.
+	state.Time = state.Time.Round(0)
+	if !reflect.DeepEqual(state, loaded) {
+		t.Fatalf("expected %+v, got %+v\n", state, loaded)
+	}
+}
@@ -0,0 +1,177 @@
+/*
+   rtldavis, an rtl-sdr receiver for Davis Instruments weather stations.
+   Copyright (C) 2015  Douglas Hall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package receiver
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Counts are the reception statistics of a transmitter or channel.
+type Counts struct {
+	// Packets received and the dwell slots a packet was expected in, with
+	// the tuner on its channel, but none arrived.
+	Received int `json:"received"`
+	Missed   int `json:"missed"`
+
+	// Packets failing their CRC and packets received more than once.
+	CRCErrors  int `json:"crc_errors"`
+	Duplicates int `json:"duplicates"`
+
+	// Times synchronization with the hop pattern was gained and lost.
+	Resyncs  int `json:"resyncs"`
+	SyncLost int `json:"sync_lost"`
+
+	// Mean frequency error of the packets received in Hz.
+	FreqError float64 `json:"freq_error"`
+
+	freqErrSum int
+}
+
+// Reception returns the percentage of expected packets that were received,
+// like the reception percentage shown by the Davis console.
+func (c Counts) Reception() float64 {
+	if c.Received+c.Missed == 0 {
+		return 0
+	}
+	return 100 * float64(c.Received) / float64(c.Received+c.Missed)
+}
+
+func (c Counts) String() string {
+	return fmt.Sprintf("%0.1f%% received:%d missed:%d crc:%d dup:%d resyncs:%d lost:%d freq_error:%0.0fHz",
+		c.Reception(), c.Received, c.Missed, c.CRCErrors, c.Duplicates, c.Resyncs, c.SyncLost, c.FreqError,
+	)
+}
+
+// Stats are the reception statistics of a receiver since Since, keyed by
+// transmitter id and channel index.
+type Stats struct {
+	Since        time.Time      `json:"since"`
+	Transmitters map[int]Counts `json:"transmitters"`
+	Channels     map[int]Counts `json:"channels"`
+
+	// Times the receiver was retuned and, if the source can drop samples,
+	// the number of times it did.
+	Hops     int   `json:"hops"`
+	Overruns int64 `json:"overruns"`
+}
+
+// IDs returns the transmitter ids in the statistics in ascending order.
+func (s Stats) IDs() []int {
+	ids := make([]int, 0, len(s.Transmitters))
+	for id := range s.Transmitters {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// collector accumulates statistics from the receiver and scheduler. A nil
+// collector discards everything.
+type collector struct {
+	mu    sync.Mutex
+	stats Stats
+}
+
+func newCollector(since time.Time) *collector {
+	return &collector{stats: Stats{
+		Since:        since,
+		Transmitters: make(map[int]Counts),
+		Channels:     make(map[int]Counts),
+	}}
+}
+
+// update applies fn to the counts of a transmitter and channel. Negative ids
+// and channels are skipped.
+func (c *collector) update(id, channel int, fn func(*Counts)) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if id >= 0 {
+		counts := c.stats.Transmitters[id]
+		fn(&counts)
+		c.stats.Transmitters[id] = counts
+	}
+	if channel >= 0 {
+		counts := c.stats.Channels[channel]
+		fn(&counts)
+		c.stats.Channels[channel] = counts
+	}
+}
+
+func (c *collector) received(id, channel, freqErr int) {
+	c.update(id, channel, func(counts *Counts) {
+		counts.Received++
+		counts.freqErrSum += freqErr
+		counts.FreqError = float64(counts.freqErrSum) / float64(counts.Received)
+	})
+}
+
+func (c *collector) missed(id, channel int) {
+	c.update(id, channel, func(counts *Counts) { counts.Missed++ })
+}
+
+func (c *collector) crcErrors(id, channel, n int) {
+	c.update(id, channel, func(counts *Counts) { counts.CRCErrors += n })
+}
+
+func (c *collector) duplicate(id, channel int) {
+	c.update(id, channel, func(counts *Counts) { counts.Duplicates++ })
+}
+
+func (c *collector) hop() {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.stats.Hops++
+}
+
+func (c *collector) resync(id int) {
+	c.update(id, -1, func(counts *Counts) { counts.Resyncs++ })
+}
+
+func (c *collector) syncLost(id int) {
+	c.update(id, -1, func(counts *Counts) { counts.SyncLost++ })
+}
+
+// snapshot returns a copy of the statistics.
+func (c *collector) snapshot() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s := c.stats
+	s.Transmitters = make(map[int]Counts, len(c.stats.Transmitters))
+	s.Channels = make(map[int]Counts, len(c.stats.Channels))
+	for id, counts := range c.stats.Transmitters {
+		s.Transmitters[id] = counts
+	}
+	for channel, counts := range c.stats.Channels {
+		s.Channels[channel] = counts
+	}
+	return s
+}
@@ -0,0 +1,150 @@
+/*
+   rtldavis, an rtl-sdr receiver for Davis Instruments weather stations.
+   Copyright (C) 2015  Douglas Hall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"io"
+	"sync/atomic"
+
+	"github.com/jpoirier/gortlsdr"
+)
+
+// blockBuffers is the number of blocks buffered between the dongle and the
+// reader before blocks are dropped.
+const blockBuffers = 64
+
+// rtlSDR is a source.Source reading samples from a local rtl-sdr dongle.
+type rtlSDR struct {
+	dev *rtlsdr.Context
+
+	blocks  chan block
+	pending []byte
+	done    chan struct{}
+
+	overruns int64
+	dropped  int64
+	buffered int64
+}
+
+// block is a block of samples and the number of samples dropped before it.
+type block struct {
+	samples []byte
+	dropped int
+}
+
+// openRTLSDR opens and configures the dongle at the given index and starts
+// streaming blocks of blockSize bytes.
+func openRTLSDR(index, centerFreq, sampleRate, blockSize int) (*rtlSDR, error) {
+	dev, err := rtlsdr.Open(index)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := dev.SetCenterFreq(centerFreq); err != nil {
+		dev.Close()
+		return nil, err
+	}
+
+	if err := dev.SetSampleRate(sampleRate); err != nil {
+		dev.Close()
+		return nil, err
+	}
+
+	if err := dev.SetTunerGainMode(false); err != nil {
+		dev.Close()
+		return nil, err
+	}
+
+	if err := dev.ResetBuffer(); err != nil {
+		dev.Close()
+		return nil, err
+	}
+
+	d := &rtlSDR{
+		dev:    dev,
+		blocks: make(chan block, blockBuffers),
+		done:   make(chan struct{}),
+	}
+
+	// The dongle keeps streaming whether we keep up or not, rather than
+	// stall the callback drop blocks the reader hasn't made room for. The
+	// next block delivered carries the number of samples dropped before it
+	// so the reader can keep time.
+	dropped := 0
+	go dev.ReadAsync(func(buf []byte) {
+		b := block{make([]byte, len(buf)), dropped}
+		copy(b.samples, buf)
+
+		atomic.AddInt64(&d.buffered, int64(len(buf)))
+		select {
+		case d.blocks <- b:
+			dropped = 0
+		default:
+			atomic.AddInt64(&d.buffered, -int64(len(buf)))
+			atomic.AddInt64(&d.overruns, 1)
+			dropped += len(buf) >> 1
+		}
+	}, nil, 1, blockSize)
+
+	return d, nil
+}
+
+func (d *rtlSDR) Read(buf []byte) (int, error) {
+	if len(d.pending) == 0 {
+		select {
+		case b := <-d.blocks:
+			d.pending = b.samples
+			atomic.AddInt64(&d.dropped, int64(b.dropped))
+		case <-d.done:
+			return 0, io.EOF
+		}
+	}
+
+	n := copy(buf, d.pending)
+	d.pending = d.pending[n:]
+	atomic.AddInt64(&d.buffered, -int64(n))
+	return n, nil
+}
+
+// Overruns returns the number of blocks dropped because they weren't read in
+// time.
+func (d *rtlSDR) Overruns() int64 {
+	return atomic.LoadInt64(&d.overruns)
+}
+
+// Dropped returns the number of samples dropped before the samples read so
+// far.
+func (d *rtlSDR) Dropped() int64 {
+	return atomic.LoadInt64(&d.dropped)
+}
+
+// Buffered returns the number of samples received from the dongle but not
+// yet read.
+func (d *rtlSDR) Buffered() int64 {
+	return atomic.LoadInt64(&d.buffered) >> 1
+}
+
+func (d *rtlSDR) SetCenterFreq(freq int) error {
+	return d.dev.SetCenterFreq(freq)
+}
+
+func (d *rtlSDR) Close() error {
+	close(d.done)
+	d.dev.CancelAsync()
+	return d.dev.Close()
+}
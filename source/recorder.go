@@ -0,0 +1,181 @@
+/*
+   rtldavis, an rtl-sdr receiver for Davis Instruments weather stations.
+   Copyright (C) 2015  Douglas Hall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package source
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Tuning is a single entry in a recording's sidecar. The first entry records
+// the sample rate and initial center frequency, each following entry records
+// a retune and the sample it took effect at. For sources that don't report
+// what they've buffered that's the sample after those read at the retune,
+// the retune takes effect some buffered samples later.
+type Tuning struct {
+	Time       time.Time `json:"time"`
+	Sample     int64     `json:"sample"`
+	CenterFreq int       `json:"center_freq"`
+	SampleRate int       `json:"sample_rate,omitempty"`
+}
+
+// Recorder wraps a source and writes every sample read from it to a
+// recording, and every retune to a sidecar as JSON, one entry per line.
+type Recorder struct {
+	Source
+
+	samples io.WriteCloser
+	sidecar io.WriteCloser
+	enc     *json.Encoder
+
+	mu      sync.Mutex
+	count   int64
+	dropped int64
+}
+
+// NewRecorder returns a recorder writing samples read from src to samples and
+// tuning history to sidecar.
+func NewRecorder(src Source, samples, sidecar io.WriteCloser, sampleRate, centerFreq int) (*Recorder, error) {
+	r := &Recorder{
+		Source:  src,
+		samples: samples,
+		sidecar: sidecar,
+		enc:     json.NewEncoder(sidecar),
+	}
+
+	err := r.enc.Encode(Tuning{
+		Time:       time.Now(),
+		CenterFreq: centerFreq,
+		SampleRate: sampleRate,
+	})
+
+	return r, err
+}
+
+// Create creates a recording with the given name and a sidecar named
+// name + ".hops" and returns a recorder writing to them.
+func Create(src Source, name string, sampleRate, centerFreq int) (*Recorder, error) {
+	samples, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+
+	sidecar, err := os.Create(name + ".hops")
+	if err != nil {
+		samples.Close()
+		return nil, err
+	}
+
+	r, err := NewRecorder(src, samples, sidecar, sampleRate, centerFreq)
+	if err != nil {
+		samples.Close()
+		sidecar.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *Recorder) Read(buf []byte) (n int, err error) {
+	n, err = r.Source.Read(buf)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Samples the source dropped are recorded as silence so the recording
+	// keeps time.
+	if dropped := r.Dropped(); dropped > r.dropped {
+		gap := make([]byte, (dropped-r.dropped)<<1)
+		for idx := range gap {
+			gap[idx] = 127
+		}
+		if _, werr := r.samples.Write(gap); werr != nil && err == nil {
+			err = werr
+		}
+		r.count += int64(len(gap))
+		r.dropped = dropped
+	}
+
+	if _, werr := r.samples.Write(buf[:n]); werr != nil && err == nil {
+		err = werr
+	}
+	r.count += int64(n)
+
+	return n, err
+}
+
+func (r *Recorder) SetCenterFreq(freq int) error {
+	if err := r.Source.SetCenterFreq(freq); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Each sample is an interleaved pair of bytes. Samples already buffered
+	// by the source were received before the retune.
+	return r.enc.Encode(Tuning{
+		Time:       time.Now(),
+		Sample:     r.count>>1 + r.Buffered(),
+		CenterFreq: freq,
+	})
+}
+
+// Overruns returns the overruns of the recorded source, if it has any.
+func (r *Recorder) Overruns() int64 {
+	if o, ok := r.Source.(Overrunner); ok {
+		return o.Overruns()
+	}
+	return 0
+}
+
+// Dropped returns the samples dropped by the recorded source, if it drops
+// any.
+func (r *Recorder) Dropped() int64 {
+	if d, ok := r.Source.(Dropper); ok {
+		return d.Dropped()
+	}
+	return 0
+}
+
+// Buffered returns the samples buffered by the recorded source, if it
+// buffers any.
+func (r *Recorder) Buffered() int64 {
+	if b, ok := r.Source.(Bufferer); ok {
+		return b.Buffered()
+	}
+	return 0
+}
+
+func (r *Recorder) Close() error {
+	err := r.Source.Close()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if serr := r.samples.Close(); err == nil {
+		err = serr
+	}
+	if serr := r.sidecar.Close(); err == nil {
+		err = serr
+	}
+
+	return err
+}
@@ -0,0 +1,104 @@
+package source
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+type nopCloser struct {
+	*bytes.Buffer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+// bufferedFile is a recording that claims some samples are buffered.
+type bufferedFile struct {
+	*File
+	buffered int64
+}
+
+func (b bufferedFile) Buffered() int64 {
+	return b.buffered
+}
+
+func TestRecorder(t *testing.T) {
+	input := make([]byte, 4096)
+	for idx := range input {
+		input[idx] = byte(idx)
+	}
+
+	samples := nopCloser{new(bytes.Buffer)}
+	sidecar := nopCloser{new(bytes.Buffer)}
+
+	src := NewFile(ioutil.NopCloser(bytes.NewReader(input)))
+	r, err := NewRecorder(src, samples, sidecar, 268800, 902355835)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block := make([]byte, 1024)
+	if _, err := io.ReadFull(r, block); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.SetCenterFreq(902857585); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+
+	if !bytes.Equal(samples.Bytes(), input) {
+		t.Fatalf("recorded %d bytes, expected %d\n", samples.Len(), len(input))
+	}
+
+	var tunings []Tuning
+	scanner := bufio.NewScanner(sidecar)
+	for scanner.Scan() {
+		var tuning Tuning
+		if err := json.Unmarshal(scanner.Bytes(), &tuning); err != nil {
+			t.Fatal(err)
+		}
+		tunings = append(tunings, tuning)
+	}
+
+	if len(tunings) != 2 {
+		t.Fatalf("expected 2 sidecar entries, got %d\n", len(tunings))
+	}
+	if tunings[0].SampleRate != 268800 || tunings[0].CenterFreq != 902355835 {
+		t.Fatalf("bad header: %+v\n", tunings[0])
+	}
+	if tunings[1].Sample != 512 || tunings[1].CenterFreq != 902857585 {
+		t.Fatalf("bad retune: %+v\n", tunings[1])
+	}
+
+	// A retune takes effect after the samples the source has buffered.
+	sidecar.Reset()
+	src = NewFile(ioutil.NopCloser(bytes.NewReader(input)))
+	r, err = NewRecorder(bufferedFile{src, 100}, nopCloser{new(bytes.Buffer)}, sidecar, 268800, 902355835)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(r, block); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.SetCenterFreq(902857585); err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+
+	lines := bytes.Split(bytes.TrimSpace(sidecar.Bytes()), []byte("\n"))
+	var tuning Tuning
+	if err := json.Unmarshal(lines[len(lines)-1], &tuning); err != nil {
+		t.Fatal(err)
+	}
+	if tuning.Sample != 612 {
+		t.Fatalf("expected retune at sample 612, got %d\n", tuning.Sample)
+	}
+}
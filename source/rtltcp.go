@@ -0,0 +1,147 @@
+/*
+   rtldavis, an rtl-sdr receiver for Davis Instruments weather stations.
+   Copyright (C) 2015  Douglas Hall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package source
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// Commands understood by rtl_tcp. Each is sent as the command byte followed
+// by a big-endian 32-bit parameter.
+const (
+	cmdCenterFreq     = 0x01
+	cmdSampleRate     = 0x02
+	cmdGainMode       = 0x03
+	cmdGain           = 0x04
+	cmdFreqCorrection = 0x05
+	cmdAGCMode        = 0x08
+)
+
+// DongleInfo is the header rtl_tcp sends when a client connects.
+type DongleInfo struct {
+	Magic     [4]byte
+	TunerType uint32
+	GainCount uint32
+}
+
+func (d DongleInfo) String() string {
+	return fmt.Sprintf("{Magic:%q TunerType:%d GainCount:%d}", d.Magic[:], d.TunerType, d.GainCount)
+}
+
+// RTLTCP is a source reading samples from an rtl_tcp server.
+type RTLTCP struct {
+	Info DongleInfo
+
+	conn net.Conn
+	r    *bufio.Reader
+
+	mu sync.Mutex
+}
+
+// DialRTLTCP connects to the rtl_tcp server at addr and configures it for the
+// given center frequency and sample rate with automatic gain.
+func DialRTLTCP(addr string, centerFreq, sampleRate int) (*RTLTCP, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &RTLTCP{conn: conn, r: bufio.NewReader(conn)}
+
+	if err := binary.Read(s.r, binary.BigEndian, &s.Info); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("reading dongle info: %s", err)
+	}
+	if string(s.Info.Magic[:]) != "RTL0" {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected dongle info magic: %q", s.Info.Magic[:])
+	}
+
+	for _, cmd := range []func() error{
+		func() error { return s.SetSampleRate(sampleRate) },
+		func() error { return s.SetCenterFreq(centerFreq) },
+		func() error { return s.SetGainMode(false) },
+	} {
+		if err := cmd(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+func (s *RTLTCP) command(cmd byte, param uint32) error {
+	var buf [5]byte
+	buf[0] = cmd
+	binary.BigEndian.PutUint32(buf[1:], param)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := s.conn.Write(buf[:])
+	return err
+}
+
+func (s *RTLTCP) Read(buf []byte) (int, error) {
+	return s.r.Read(buf)
+}
+
+func (s *RTLTCP) SetCenterFreq(freq int) error {
+	return s.command(cmdCenterFreq, uint32(freq))
+}
+
+func (s *RTLTCP) SetSampleRate(rate int) error {
+	return s.command(cmdSampleRate, uint32(rate))
+}
+
+// SetGainMode selects manual gain if true, automatic gain otherwise.
+func (s *RTLTCP) SetGainMode(manual bool) error {
+	return s.command(cmdGainMode, boolParam(manual))
+}
+
+// SetGain sets the tuner gain in tenths of a dB. Only effective in manual
+// gain mode.
+func (s *RTLTCP) SetGain(gain int) error {
+	return s.command(cmdGain, uint32(gain))
+}
+
+// SetFreqCorrection sets the frequency correction in ppm.
+func (s *RTLTCP) SetFreqCorrection(ppm int) error {
+	return s.command(cmdFreqCorrection, uint32(int32(ppm)))
+}
+
+// SetAGCMode enables or disables the RTL2832's digital AGC.
+func (s *RTLTCP) SetAGCMode(on bool) error {
+	return s.command(cmdAGCMode, boolParam(on))
+}
+
+func (s *RTLTCP) Close() error {
+	return s.conn.Close()
+}
+
+func boolParam(b bool) uint32 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,106 @@
+package source
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+)
+
+type command struct {
+	Cmd   byte
+	Param uint32
+}
+
+// fakeRTLTCP accepts a single client, sends the dongle info header and
+// samples, then reports each command it receives.
+func fakeRTLTCP(t *testing.T, samples []byte) (addr string, cmds <-chan command) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ch := make(chan command, 16)
+	go func() {
+		defer l.Close()
+		defer close(ch)
+
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		info := DongleInfo{TunerType: 5, GainCount: 29}
+		copy(info.Magic[:], "RTL0")
+		binary.Write(conn, binary.BigEndian, info)
+		conn.Write(samples)
+
+		var buf [5]byte
+		for {
+			if _, err := io.ReadFull(conn, buf[:]); err != nil {
+				return
+			}
+			ch <- command{buf[0], binary.BigEndian.Uint32(buf[1:])}
+		}
+	}()
+
+	return l.Addr().String(), ch
+}
+
+func TestRTLTCP(t *testing.T) {
+	samples := make([]byte, 2048)
+	for idx := range samples {
+		samples[idx] = byte(idx)
+	}
+
+	addr, cmds := fakeRTLTCP(t, samples)
+
+	s, err := DialRTLTCP(addr, 902355835, 268800)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(s.Info.Magic[:]) != "RTL0" || s.Info.TunerType != 5 || s.Info.GainCount != 29 {
+		t.Fatalf("bad dongle info: %s\n", s.Info)
+	}
+
+	block := make([]byte, len(samples))
+	if _, err := io.ReadFull(s, block); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(block, samples) {
+		t.Fatalf("samples don't match\n")
+	}
+
+	if err := s.SetCenterFreq(902857585); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetFreqCorrection(-2); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	expected := []command{
+		{cmdSampleRate, 268800},
+		{cmdCenterFreq, 902355835},
+		{cmdGainMode, 0},
+		{cmdCenterFreq, 902857585},
+		{cmdFreqCorrection, 0xFFFFFFFE},
+	}
+
+	var received []command
+	for cmd := range cmds {
+		received = append(received, cmd)
+	}
+
+	if len(received) != len(expected) {
+		t.Fatalf("expected %d commands, got %d: %+v\n", len(expected), len(received), received)
+	}
+	for idx := range expected {
+		if received[idx] != expected[idx] {
+			t.Fatalf("command %d: expected %+v, got %+v\n", idx, expected[idx], received[idx])
+		}
+	}
+}
@@ -0,0 +1,104 @@
+/*
+   rtldavis, an rtl-sdr receiver for Davis Instruments weather stations.
+   Copyright (C) 2015  Douglas Hall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package vantage
+
+import (
+	"math"
+
+	"github.com/bemasher/rtldavis/weather"
+)
+
+// EEPROMSize is the size of the console's configuration EEPROM.
+const EEPROMSize = 4096
+
+// Console types returned by WRD 0x12 0x4D.
+const (
+	TypeVantagePro = 16
+	TypeVantageVue = 17
+)
+
+// Addresses of the EEPROM settings clients read when they start.
+const (
+	eeLatitude      = 0x0B
+	eeLongitude     = 0x0D
+	eeElevation     = 0x0F
+	eeUsedTx        = 0x17
+	eeStationList   = 0x19
+	eeUnitBits      = 0x29
+	eeUnitBitsComp  = 0x2A
+	eeSetupBits     = 0x2B
+	eeRainSeason    = 0x2C
+	eeArchivePeriod = 0x2D
+)
+
+// Station types in the low nibble of each station list entry.
+const (
+	stationISS  = 0
+	stationNone = 10
+)
+
+// consoleType returns the console that matches the station's anemometer.
+func consoleType(c weather.Conditions) byte {
+	if c.Wind.Encoding == weather.Vue {
+		return TypeVantageVue
+	}
+	return TypeVantagePro
+}
+
+// newEEPROM returns the image of a freshly configured console: units are
+// the US defaults, the archive period is 30 minutes and there are no
+// calibration offsets. The ISS and rain collector match the station's.
+func newEEPROM(c weather.Conditions) []byte {
+	ee := make([]byte, EEPROMSize)
+
+	put16(ee, eeLatitude, 0)
+	put16(ee, eeLongitude, 0)
+	put16(ee, eeElevation, 0)
+
+	iss := 0
+	if c.ISSID > 0 && c.ISSID < 8 {
+		iss = c.ISSID
+	}
+	ee[eeUsedTx] = 1 << uint(iss)
+	for idx := 0; idx < 8; idx++ {
+		ee[eeStationList+idx*2] = stationNone
+		ee[eeStationList+idx*2+1] = 0xFF
+	}
+	ee[eeStationList+iss*2] = stationISS
+
+	// Barometer in inHg, temperature in °F, elevation in feet, rain in
+	// inches and wind in mph.
+	ee[eeUnitBits] = 0
+	ee[eeUnitBitsComp] = ^ee[eeUnitBits]
+
+	// Large wind cups, northern and western hemispheres. Bits 4 and 5 are
+	// the rain collector: 0.01in, 0.2mm or 0.1mm.
+	setup := byte(0x08 | 0x40)
+	switch {
+	case math.Abs(c.Rain.Bucket-0.2/25.4) < 1e-6:
+		setup |= 1 << 4
+	case math.Abs(c.Rain.Bucket-0.1/25.4) < 1e-6:
+		setup |= 2 << 4
+	}
+	ee[eeSetupBits] = setup
+
+	ee[eeRainSeason] = 1
+	ee[eeArchivePeriod] = 30
+
+	return ee
+}
@@ -0,0 +1,288 @@
+/*
+   rtldavis, an rtl-sdr receiver for Davis Instruments weather stations.
+   Copyright (C) 2015  Douglas Hall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package vantage
+
+import (
+	"encoding/binary"
+	"math"
+	"time"
+
+	"github.com/bemasher/rtldavis/crc"
+	"github.com/bemasher/rtldavis/weather"
+)
+
+// Packet lengths including the trailing CRC.
+const (
+	LoopLength   = 99
+	HiLowsLength = 438
+	PageLength   = 267
+)
+
+// ArchivePages is the number of pages in the console's archive memory, each
+// holding five records.
+const ArchivePages = 512
+
+// Values the console reports for readings it doesn't have.
+const (
+	dashedTemp     = 0x7FFF
+	dashedByte     = 0xFF
+	dashedSolar    = 0x7FFF
+	dashedWord     = 0xFFFF
+	dashedBarTrend = 80 // 'P', no barometric trend available
+
+	// LOOP2's dew point, heat index, wind chill and THSW index are signed
+	// words, but dashed as a byte.
+	dashedIndex = 0xFF
+)
+
+// The console uses the same CRC as the transmitters. A packet followed by
+// its big-endian CRC checksums to zero.
+var consoleCRC = crc.NewCRC("CCITT-16", 0, 0x1021, 0)
+
+// appendCRC fills the last two bytes of buf with the CRC of the rest.
+func appendCRC(buf []byte) {
+	n := len(buf) - 2
+	binary.BigEndian.PutUint16(buf[n:], consoleCRC.Checksum(buf[:n]))
+}
+
+func put16(buf []byte, offset int, value uint16) {
+	binary.LittleEndian.PutUint16(buf[offset:], value)
+}
+
+// tenths encodes a reading in tenths of a unit as a signed 16-bit value, or
+// dashed if invalid.
+func tenths(r weather.Reading, dashed uint16) uint16 {
+	if !r.Valid() {
+		return dashed
+	}
+	return uint16(int16(math.Floor(r.Value*10 + 0.5)))
+}
+
+// whole encodes a reading rounded to whole units, or dashed if invalid.
+func whole(r weather.Reading, dashed uint16) uint16 {
+	if !r.Valid() {
+		return dashed
+	}
+	return uint16(int16(math.Floor(r.Value + 0.5)))
+}
+
+// wholeByte encodes a reading rounded to whole units as a single byte, or
+// dashed if invalid.
+func wholeByte(r weather.Reading) byte {
+	if !r.Valid() || r.Value < 0 || r.Value >= dashedByte {
+		return dashedByte
+	}
+	return byte(math.Floor(r.Value + 0.5))
+}
+
+// direction encodes a wind direction in whole degrees. Zero means no
+// reading, so north is 360.
+func direction(r weather.Reading) uint16 {
+	d := whole(r, 0)
+	if r.Valid() && (d == 0 || d > 360) {
+		return 360
+	}
+	return d
+}
+
+// timeOfDay encodes the time of a reading as hours*100 + minutes.
+func timeOfDay(r weather.Reading) uint16 {
+	if !r.Valid() {
+		return dashedWord
+	}
+	return uint16(r.Time.Hour()*100 + r.Time.Minute())
+}
+
+// date encodes a date as month<<12 | day<<7 | year-2000.
+func date(t time.Time) uint16 {
+	return uint16(t.Month())<<12 | uint16(t.Day())<<7 | uint16(t.Year()-2000)
+}
+
+// header fills the fields common to LOOP and LOOP2 packets.
+func header(buf []byte, packetType byte, c weather.Conditions) {
+	copy(buf, "LOO")
+	buf[3] = dashedBarTrend
+	buf[4] = packetType
+
+	// Barometer, inside temperature and inside humidity are measured by the
+	// console itself, we don't have them.
+	put16(buf, 7, 0)
+	put16(buf, 9, dashedTemp)
+	buf[11] = dashedByte
+
+	put16(buf, 12, tenths(c.OutsideTemp, dashedTemp))
+	buf[14] = wholeByte(c.WindSpeed)
+	put16(buf, 16, direction(c.WindDirection))
+	buf[33] = wholeByte(c.OutsideHumidity)
+
+	// Rain rate is in bucket tips per hour, which the console calls clicks.
+	put16(buf, 41, whole(c.RainRate, 0))
+	buf[43] = byte(tenths(c.UVIndex, dashedByte))
+	put16(buf, 44, whole(c.SolarRadiation, dashedSolar))
+
+	// Storm rain in hundredths of an inch, the storm's start date and the
+	// day's rain in bucket tips.
+	if c.Rain.InStorm(c.Updated) {
+		put16(buf, 46, uint16(c.Rain.Storm*100+0.5))
+		put16(buf, 48, date(c.Rain.StormStart))
+	} else {
+		put16(buf, 48, dashedWord)
+	}
+	put16(buf, 50, uint16(c.Rain.Tips(c.Rain.Day)))
+
+	// Day ET in thousandths of an inch.
+	if c.DayET.Valid() {
+		put16(buf, 56, uint16(math.Floor(c.DayET.Value*1000+0.5)))
+	}
+
+	buf[95] = '\n'
+	buf[96] = '\r'
+}
+
+// Loop returns a LOOP packet describing the current conditions.
+func Loop(c weather.Conditions) []byte {
+	buf := make([]byte, LoopLength)
+	header(buf, 0, c)
+
+	// Next archive record.
+	put16(buf, 5, 0)
+
+	// Ten minute average wind speed.
+	buf[15] = wholeByte(c.WindSpeedLong)
+
+	// Extra temperatures, soil temperatures, leaf temperatures and extra
+	// humidities.
+	for idx := 18; idx < 33; idx++ {
+		buf[idx] = dashedByte
+	}
+	for idx := 34; idx < 41; idx++ {
+		buf[idx] = dashedByte
+	}
+
+	// Soil moistures and leaf wetnesses.
+	for idx := 62; idx < 70; idx++ {
+		buf[idx] = dashedByte
+	}
+
+	// Month and year rain in bucket tips.
+	put16(buf, 52, uint16(c.Rain.Tips(c.Rain.Month)))
+	put16(buf, 54, uint16(c.Rain.Tips(c.Rain.Year)))
+
+	// Transmitter battery status, a bit for each transmitter set while its
+	// battery is low.
+	buf[86] = c.BatteryLow
+
+	// Console battery voltage, nominal 4.5V.
+	put16(buf, 87, uint16(4.5*100*512/300))
+
+	appendCRC(buf)
+	return buf
+}
+
+// Loop2 returns a LOOP2 packet describing the current conditions.
+func Loop2(c weather.Conditions) []byte {
+	buf := make([]byte, LoopLength)
+	header(buf, 1, c)
+
+	put16(buf, 5, 0x7FFF)
+	buf[15] = dashedByte
+
+	// Ten and two minute average wind speeds in tenths of a mph, and the
+	// ten minute gust and its direction.
+	put16(buf, 18, tenths(c.WindSpeedLong, 0))
+	put16(buf, 20, tenths(c.WindSpeedShort, 0))
+	put16(buf, 22, whole(c.WindGustLong, 0))
+	put16(buf, 24, direction(c.WindGustDirection))
+
+	put16(buf, 26, 0x7FFF)
+	put16(buf, 28, 0x7FFF)
+
+	// Dew point, heat index, wind chill and THSW in whole °F.
+	put16(buf, 30, whole(c.DewPoint, dashedIndex))
+	buf[32] = dashedByte
+	buf[34] = dashedByte
+	put16(buf, 35, whole(c.HeatIndex, dashedIndex))
+	put16(buf, 37, whole(c.WindChill, dashedIndex))
+	put16(buf, 39, whole(c.THSWIndex, dashedIndex))
+
+	buf[71] = dashedByte
+	for idx := 83; idx < 95; idx++ {
+		buf[idx] = dashedByte
+	}
+
+	appendCRC(buf)
+	return buf
+}
+
+// HiLows returns a HILOWS packet with the day's highs and lows. Only wind
+// speed, outside temperature and outside humidity are tracked, everything
+// else is dashed.
+func HiLows(c weather.Conditions) []byte {
+	buf := make([]byte, HiLowsLength)
+	for idx := range buf {
+		buf[idx] = dashedByte
+	}
+
+	// Barometer.
+	for idx := 0; idx < 12; idx++ {
+		buf[idx] = 0
+	}
+
+	// Wind speed.
+	buf[16] = wholeByte(c.DayWindSpeed.High)
+	put16(buf, 17, timeOfDay(c.DayWindSpeed.High))
+
+	// Outside temperature.
+	put16(buf, 47, tenths(c.DayOutsideTemp.Low, dashedTemp))
+	put16(buf, 49, tenths(c.DayOutsideTemp.High, dashedTemp))
+	put16(buf, 51, timeOfDay(c.DayOutsideTemp.Low))
+	put16(buf, 53, timeOfDay(c.DayOutsideTemp.High))
+
+	// Outside humidity is the first of each group of humidities.
+	buf[276] = wholeByte(c.DayOutsideHumidity.Low)
+	buf[284] = wholeByte(c.DayOutsideHumidity.High)
+	put16(buf, 292, timeOfDay(c.DayOutsideHumidity.Low))
+	put16(buf, 308, timeOfDay(c.DayOutsideHumidity.High))
+
+	appendCRC(buf)
+	return buf
+}
+
+// archivePage returns an archive page of unused records: a sequence number,
+// five 52 byte records, four unused bytes and CRC.
+func archivePage(page int) []byte {
+	buf := make([]byte, PageLength)
+	buf[0] = byte(page)
+	for idx := 1; idx < 1+5*52; idx++ {
+		buf[idx] = dashedByte
+	}
+	appendCRC(buf)
+	return buf
+}
+
+// consoleTime returns the GETTIME response for t: seconds, minutes, hours,
+// day, month and years since 1900 followed by CRC.
+func consoleTime(t time.Time) []byte {
+	buf := []byte{
+		byte(t.Second()), byte(t.Minute()), byte(t.Hour()),
+		byte(t.Day()), byte(t.Month()), byte(t.Year() - 1900),
+		0, 0,
+	}
+	appendCRC(buf)
+	return buf
+}
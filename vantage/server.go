@@ -0,0 +1,434 @@
+/*
+   rtldavis, an rtl-sdr receiver for Davis Instruments weather stations.
+   Copyright (C) 2015  Douglas Hall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package vantage
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bemasher/rtldavis/weather"
+)
+
+const (
+	ack    = 0x06
+	nak    = 0x21
+	esc    = 0x1B
+	badCRC = 0x18
+)
+
+// binaryCommands are followed by binary data from the client rather than
+// another line.
+var binaryCommands = map[string]bool{
+	"SETTIME": true,
+	"DMP":     true,
+	"DMPAFT":  true,
+}
+
+// Valid archive periods in minutes.
+var archivePeriods = map[int]bool{1: true, 5: true, 10: true, 15: true, 30: true, 60: true, 120: true}
+
+// Server emulates a Vantage console's serial protocol over TCP, serving the
+// current conditions written to it by a weather.Station. It understands the
+// wakeup sequence and the TEST, VER, NVER, RXCHECK, GETTIME, LOOP, LPS,
+// HILOWS, WRD, EEBRD and EERD commands. SETTIME and SETPER are acknowledged
+// but the clock is always the host's, and the archive is always empty for
+// DMP and DMPAFT.
+type Server struct {
+	// LoopInterval is the time between packets in response to LOOP and
+	// LPS, two seconds on a real console.
+	LoopInterval time.Duration
+
+	mu         sync.Mutex
+	conditions weather.Conditions
+	received   int
+	eeprom     []byte
+}
+
+func NewServer(c weather.Conditions) *Server {
+	return &Server{
+		LoopInterval: 2 * time.Second,
+		conditions:   c,
+		eeprom:       newEEPROM(c),
+	}
+}
+
+// WriteConditions replaces the current conditions after each decoded
+// message.
+func (s *Server) WriteConditions(c weather.Conditions) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.conditions = c
+	s.received++
+
+	return nil
+}
+
+// Conditions returns a copy of the current conditions, with rain totals
+// rolled over to now.
+func (s *Server) Conditions() weather.Conditions {
+	s.mu.Lock()
+	c := s.conditions
+	s.mu.Unlock()
+
+	c.Rain.Rollover(time.Now())
+	return c
+}
+
+// ListenAndServe listens on the TCP address addr and serves clients.
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts connections on l and serves each concurrently.
+func (s *Server) Serve(l net.Listener) error {
+	defer l.Close()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+// client is a connection to a client. Lines are read in the background so a
+// LOOP in progress can be cancelled by the client. After a command that is
+// followed by binary data the background reader waits until the command has
+// read it from r and sends on resume.
+type client struct {
+	io.Writer
+	r      *bufio.Reader
+	lines  chan string
+	resume chan struct{}
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	c := &client{
+		Writer: conn,
+		r:      bufio.NewReader(conn),
+		lines:  make(chan string),
+		resume: make(chan struct{}),
+	}
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		defer close(c.lines)
+
+		for {
+			line, err := c.r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimSpace(line)
+
+			select {
+			case c.lines <- line:
+			case <-done:
+				return
+			}
+
+			if fields := strings.Fields(strings.ToUpper(line)); len(fields) > 0 && binaryCommands[fields[0]] {
+				select {
+				case <-c.resume:
+				case <-done:
+					return
+				}
+			}
+		}
+	}()
+
+	for line := range c.lines {
+		for {
+			// An empty line is the wakeup sequence.
+			if line == "" {
+				if _, err := io.WriteString(conn, "\n\r"); err != nil {
+					return
+				}
+				break
+			}
+
+			next, interrupted, err := s.command(c, line)
+			if err != nil {
+				return
+			}
+			if !interrupted {
+				break
+			}
+			line = next
+		}
+	}
+}
+
+// command executes a single command. If a LOOP or LPS is interrupted by the
+// client, the interrupting line is returned so it can be executed.
+func (s *Server) command(c *client, line string) (next string, interrupted bool, err error) {
+	fields := strings.Fields(strings.ToUpper(line))
+	if binaryCommands[fields[0]] {
+		defer func() { c.resume <- struct{}{} }()
+	}
+
+	// WRD's arguments are binary, 0x12 0x4D reads the console type.
+	if strings.HasPrefix(fields[0], "WRD") {
+		if line[3:] != "\x12\x4D" {
+			_, err = c.Write([]byte{nak})
+			return "", false, err
+		}
+		_, err = c.Write([]byte{ack, consoleType(s.Conditions())})
+		return "", false, err
+	}
+
+	switch fields[0] {
+	case "TEST":
+		_, err = io.WriteString(c, "\n\rTEST\n\r")
+	case "VER":
+		_, err = io.WriteString(c, "\n\rOK\n\rApr 10 2013\n\r")
+	case "NVER":
+		_, err = io.WriteString(c, "\n\rOK\n\r3.00\n\r")
+	case "RXCHECK":
+		s.mu.Lock()
+		received := s.received
+		s.mu.Unlock()
+		_, err = fmt.Fprintf(c, "\n\rOK\n\r %d 0 0 0 0\n\r", received)
+	case "GETTIME":
+		_, err = c.Write(append([]byte{ack}, consoleTime(time.Now())...))
+	case "SETTIME":
+		err = s.setTime(c)
+	case "SETPER":
+		err = s.setPeriod(c, fields[1:])
+	case "EEBRD", "EERD":
+		err = s.readEEPROM(c, fields)
+	case "DMP":
+		err = s.dump(c)
+	case "DMPAFT":
+		err = s.dumpAfter(c)
+	case "HILOWS":
+		_, err = c.Write(append([]byte{ack}, HiLows(s.Conditions())...))
+	case "LOOP":
+		if len(fields) != 2 {
+			_, err = c.Write([]byte{nak})
+			break
+		}
+		return s.loop(c, 1, fields[1])
+	case "LPS":
+		if len(fields) != 3 {
+			_, err = c.Write([]byte{nak})
+			break
+		}
+		mask, perr := strconv.Atoi(fields[1])
+		if perr != nil || mask&3 == 0 {
+			_, err = c.Write([]byte{nak})
+			break
+		}
+		return s.loop(c, mask&3, fields[2])
+	default:
+		_, err = c.Write([]byte{nak})
+	}
+
+	return "", false, err
+}
+
+// readEEPROM responds to EEBRD with the requested bytes followed by their
+// CRC, or to EERD with each byte in hex on its own line. The address and
+// length are in hex.
+func (s *Server) readEEPROM(c *client, fields []string) error {
+	if len(fields) != 3 {
+		_, err := c.Write([]byte{nak})
+		return err
+	}
+
+	addr, aerr := strconv.ParseUint(fields[1], 16, 16)
+	n, nerr := strconv.ParseUint(fields[2], 16, 16)
+	if aerr != nil || nerr != nil || n == 0 || addr+n > EEPROMSize {
+		_, err := c.Write([]byte{nak})
+		return err
+	}
+
+	s.mu.Lock()
+	data := append([]byte{}, s.eeprom[addr:addr+n]...)
+	s.mu.Unlock()
+
+	if fields[0] == "EERD" {
+		buf := []byte("\n\rOK\n\r")
+		for _, b := range data {
+			buf = append(buf, fmt.Sprintf("%02X\n\r", b)...)
+		}
+		_, err := c.Write(buf)
+		return err
+	}
+
+	buf := make([]byte, len(data)+3)
+	buf[0] = ack
+	copy(buf[1:], data)
+	appendCRC(buf[1:])
+	_, err := c.Write(buf)
+	return err
+}
+
+// setPeriod responds to SETPER, storing the archive period in the EEPROM
+// where clients read it back.
+func (s *Server) setPeriod(c *client, args []string) error {
+	if len(args) != 1 {
+		_, err := c.Write([]byte{nak})
+		return err
+	}
+	period, perr := strconv.Atoi(args[0])
+	if perr != nil || !archivePeriods[period] {
+		_, err := c.Write([]byte{nak})
+		return err
+	}
+
+	s.mu.Lock()
+	s.eeprom[eeArchivePeriod] = byte(period)
+	s.mu.Unlock()
+
+	_, err := c.Write([]byte{ack})
+	return err
+}
+
+// readCRC reads n bytes followed by their CRC from the client, responding
+// with an ACK if the CRC is good.
+func readCRC(c *client, n int) (ok bool, err error) {
+	buf := make([]byte, n+2)
+	if _, err := io.ReadFull(c.r, buf); err != nil {
+		return false, err
+	}
+	if consoleCRC.Checksum(buf) != 0 {
+		_, err := c.Write([]byte{badCRC})
+		return false, err
+	}
+	_, err = c.Write([]byte{ack})
+	return true, err
+}
+
+// setTime responds to SETTIME. The time sent is acknowledged but ignored,
+// the console's time is the host's.
+func (s *Server) setTime(c *client) error {
+	if _, err := c.Write([]byte{ack}); err != nil {
+		return err
+	}
+	_, err := readCRC(c, 6)
+	return err
+}
+
+// dumpAfter responds to DMPAFT. The archive is empty, so there are no pages
+// after any time.
+func (s *Server) dumpAfter(c *client) error {
+	if _, err := c.Write([]byte{ack}); err != nil {
+		return err
+	}
+	if ok, err := readCRC(c, 4); !ok || err != nil {
+		return err
+	}
+
+	// Page count and the index of the first record in the first page.
+	buf := make([]byte, 6)
+	appendCRC(buf)
+	_, err := c.Write(buf)
+	return err
+}
+
+// dump responds to DMP with the entire archive: pages of unused records,
+// each acknowledged by the client, which may cancel with ESC or request
+// the page again with NAK.
+func (s *Server) dump(c *client) error {
+	if _, err := c.Write([]byte{ack}); err != nil {
+		return err
+	}
+
+	for page := 0; page < ArchivePages; {
+		if _, err := c.Write(archivePage(page)); err != nil {
+			return err
+		}
+
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		switch b {
+		case ack:
+			page++
+		case esc:
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// loop sends count packets, alternating between LOOP and LOOP2 if both are
+// selected by mask, stopping early if the client sends anything.
+func (s *Server) loop(c *client, mask int, count string) (string, bool, error) {
+	n, err := strconv.Atoi(count)
+	if err != nil || n <= 0 {
+		_, err = c.Write([]byte{nak})
+		return "", false, err
+	}
+
+	if _, err := c.Write([]byte{ack}); err != nil {
+		return "", false, err
+	}
+
+	ticker := time.NewTicker(s.LoopInterval)
+	defer ticker.Stop()
+
+	loop2 := mask == 2
+	for {
+		var pkt []byte
+		if loop2 {
+			pkt = Loop2(s.Conditions())
+		} else {
+			pkt = Loop(s.Conditions())
+		}
+		if mask == 3 {
+			loop2 = !loop2
+		}
+
+		if _, err := c.Write(pkt); err != nil {
+			return "", false, err
+		}
+
+		n--
+		if n == 0 {
+			return "", false, nil
+		}
+
+		select {
+		case <-ticker.C:
+		case line, ok := <-c.lines:
+			if !ok {
+				return "", false, io.EOF
+			}
+			return line, true, nil
+		}
+	}
+}
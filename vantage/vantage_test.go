@@ -0,0 +1,299 @@
+package vantage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bemasher/rtldavis/dsp"
+	"github.com/bemasher/rtldavis/protocol"
+	"github.com/bemasher/rtldavis/weather"
+)
+
+func newTestServer(t *testing.T) (*Server, net.Conn, *bufio.Reader) {
+	s := NewServer(weather.NewConditions(-1, -1))
+	s.LoopInterval = 10 * time.Millisecond
+
+	// Temperature of 72.5°F, 5mph wind.
+	msg := protocol.NewMessage(dsp.Packet{Data: []byte{0xCB, 0x89, 0x80, 0x05, 0x4A, 0x2D, 0x50, 0x00, 0x12, 0x34}})
+	msg.Time = time.Now()
+	weather.NewStation(s.Conditions(), s).Write(msg)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	return s, conn, bufio.NewReader(conn)
+}
+
+func expect(t *testing.T, r io.Reader, expected string) {
+	buf := make([]byte, len(expected))
+	if _, err := io.ReadFull(r, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != expected {
+		t.Fatalf("expected %q, got %q\n", expected, buf)
+	}
+}
+
+func readPacket(t *testing.T, r io.Reader, length int) []byte {
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		t.Fatal(err)
+	}
+	if consoleCRC.Checksum(buf) != 0 {
+		t.Fatalf("bad CRC: %02X\n", buf)
+	}
+	return buf
+}
+
+func TestWakeup(t *testing.T) {
+	_, conn, r := newTestServer(t)
+	defer conn.Close()
+
+	io.WriteString(conn, "\n")
+	expect(t, r, "\n\r")
+
+	io.WriteString(conn, "TEST\n")
+	expect(t, r, "\n\rTEST\n\r")
+
+	io.WriteString(conn, "BOGUS\n")
+	expect(t, r, "\x21")
+}
+
+func TestLoop(t *testing.T) {
+	_, conn, r := newTestServer(t)
+	defer conn.Close()
+
+	io.WriteString(conn, "LOOP 2\n")
+	expect(t, r, "\x06")
+
+	for n := 0; n < 2; n++ {
+		pkt := readPacket(t, r, LoopLength)
+		if string(pkt[:3]) != "LOO" || pkt[4] != 0 {
+			t.Fatalf("bad LOOP header: %02X\n", pkt[:5])
+		}
+		if temp := int16(binary.LittleEndian.Uint16(pkt[12:])); temp != 725 {
+			t.Fatalf("expected outside temperature 725, got %d\n", temp)
+		}
+		if pkt[14] != 5 {
+			t.Fatalf("expected wind speed 5, got %d\n", pkt[14])
+		}
+		if pkt[33] != 0xFF {
+			t.Fatalf("expected dashed humidity, got %d\n", pkt[33])
+		}
+	}
+
+	io.WriteString(conn, "LPS 3 2\n")
+	expect(t, r, "\x06")
+	for _, packetType := range []byte{0, 1} {
+		pkt := readPacket(t, r, LoopLength)
+		if pkt[4] != packetType {
+			t.Fatalf("expected packet type %d, got %d\n", packetType, pkt[4])
+		}
+		if packetType != 1 {
+			continue
+		}
+
+		// Without humidity only wind chill can be derived.
+		if chill := binary.LittleEndian.Uint16(pkt[37:]); chill != 73 {
+			t.Fatalf("expected wind chill 73, got %d\n", chill)
+		}
+		if dew := binary.LittleEndian.Uint16(pkt[30:]); dew != 255 {
+			t.Fatalf("expected dashed dew point, got %d\n", dew)
+		}
+	}
+}
+
+func TestLoopFields(t *testing.T) {
+	c := weather.NewConditions(-1, -1)
+	c.Wind.Encoding = weather.Vue
+
+	// Transmitter 2 with a low battery and the wind from the north.
+	msg := protocol.NewMessage(dsp.Packet{Data: []byte{0xCB, 0x89, 0x8A, 0x05, 0x00, 0x2D, 0x50, 0x00, 0x12, 0x34}})
+	msg.Time = time.Now()
+	c.Update(msg)
+
+	pkt := Loop(c)
+	if dir := binary.LittleEndian.Uint16(pkt[16:]); dir != 360 {
+		t.Fatalf("expected north as 360, got %d\n", dir)
+	}
+	if pkt[86] != 1<<2 {
+		t.Fatalf("expected battery status %02X, got %02X\n", 1<<2, pkt[86])
+	}
+
+	msg.BatteryLow = false
+	c.Update(msg)
+	if pkt := Loop(c); pkt[86] != 0 {
+		t.Fatalf("expected battery status 00, got %02X\n", pkt[86])
+	}
+}
+
+func TestLoopInterrupt(t *testing.T) {
+	_, conn, r := newTestServer(t)
+	defer conn.Close()
+
+	io.WriteString(conn, "LOOP 1000\n")
+	expect(t, r, "\x06")
+	readPacket(t, r, LoopLength)
+
+	// Waking the console cancels the loop.
+	io.WriteString(conn, "\n")
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Skip any packets sent before the wakeup was noticed.
+		if b == 'L' {
+			io.ReadFull(r, make([]byte, LoopLength-1))
+			continue
+		}
+		if b != '\n' {
+			t.Fatalf("expected wakeup response, got %02X\n", b)
+		}
+		expect(t, r, "\r")
+		break
+	}
+}
+
+func TestHiLows(t *testing.T) {
+	_, conn, r := newTestServer(t)
+	defer conn.Close()
+
+	io.WriteString(conn, "HILOWS\n")
+	expect(t, r, "\x06")
+
+	pkt := readPacket(t, r, HiLowsLength)
+	if pkt[16] != 5 {
+		t.Fatalf("expected day high wind speed 5, got %d\n", pkt[16])
+	}
+	for _, offset := range []int{47, 49} {
+		if temp := int16(binary.LittleEndian.Uint16(pkt[offset:])); temp != 725 {
+			t.Fatalf("expected day temperature 725 at %d, got %d\n", offset, temp)
+		}
+	}
+}
+
+// eebrd reads n bytes of EEPROM at addr the way weewx does.
+func eebrd(t *testing.T, conn net.Conn, r io.Reader, addr, n int) []byte {
+	fmt.Fprintf(conn, "EEBRD %X %X\n", addr, n)
+	expect(t, r, "\x06")
+	return readPacket(t, r, n+2)[:n]
+}
+
+// sendCRC sends data followed by its CRC.
+func sendCRC(conn net.Conn, data []byte) {
+	buf := append(append([]byte{}, data...), 0, 0)
+	appendCRC(buf)
+	conn.Write(buf)
+}
+
+func TestWeewxStartup(t *testing.T) {
+	_, conn, r := newTestServer(t)
+	defer conn.Close()
+
+	io.WriteString(conn, "\n")
+	expect(t, r, "\n\r")
+
+	io.WriteString(conn, "WRD\x12\x4d\n")
+	expect(t, r, "\x06\x10")
+
+	if unit := eebrd(t, conn, r, 0x29, 1); unit[0] != 0 {
+		t.Fatalf("expected unit bits 0, got %02X\n", unit[0])
+	}
+	if setup := eebrd(t, conn, r, 0x2B, 1); setup[0]&0x30 != 0 {
+		t.Fatalf("expected 0.01in rain collector, got setup bits %02X\n", setup[0])
+	}
+	if season := eebrd(t, conn, r, 0x2C, 1); season[0] != 1 {
+		t.Fatalf("expected rain season starting in January, got %d\n", season[0])
+	}
+	if period := eebrd(t, conn, r, 0x2D, 1); period[0] != 30 {
+		t.Fatalf("expected archive period 30, got %d\n", period[0])
+	}
+	if elevation := eebrd(t, conn, r, 0x0F, 2); binary.LittleEndian.Uint16(elevation) != 0 {
+		t.Fatalf("expected elevation 0, got %02X\n", elevation)
+	}
+
+	io.WriteString(conn, "GETTIME\n")
+	expect(t, r, "\x06")
+	readPacket(t, r, 8)
+
+	io.WriteString(conn, "SETTIME\n")
+	expect(t, r, "\x06")
+	sendCRC(conn, consoleTime(time.Now())[:6])
+	expect(t, r, "\x06")
+
+	io.WriteString(conn, "SETPER 5\n")
+	expect(t, r, "\x06")
+	if period := eebrd(t, conn, r, 0x2D, 1); period[0] != 5 {
+		t.Fatalf("expected archive period 5, got %d\n", period[0])
+	}
+
+	// The archive is empty.
+	io.WriteString(conn, "DMPAFT\n")
+	expect(t, r, "\x06")
+	sendCRC(conn, []byte{0, 0, 0, 0})
+	expect(t, r, "\x06")
+	if header := readPacket(t, r, 6); binary.LittleEndian.Uint16(header) != 0 {
+		t.Fatalf("expected no pages, got %d\n", binary.LittleEndian.Uint16(header))
+	}
+
+	io.WriteString(conn, "LPS 3 2\n")
+	expect(t, r, "\x06")
+	for _, packetType := range []byte{0, 1} {
+		if pkt := readPacket(t, r, LoopLength); pkt[4] != packetType {
+			t.Fatalf("expected packet type %d, got %d\n", packetType, pkt[4])
+		}
+	}
+}
+
+func TestEEPROM(t *testing.T) {
+	_, conn, r := newTestServer(t)
+	defer conn.Close()
+
+	io.WriteString(conn, "EERD 2B 1\n")
+	expect(t, r, "\n\rOK\n\r48\n\r")
+
+	io.WriteString(conn, "EEBRD FFF 2\n")
+	expect(t, r, "\x21")
+
+	io.WriteString(conn, "SETPER 7\n")
+	expect(t, r, "\x21")
+}
+
+func TestDump(t *testing.T) {
+	_, conn, r := newTestServer(t)
+	defer conn.Close()
+
+	io.WriteString(conn, "DMP\n")
+	expect(t, r, "\x06")
+
+	// A NAK requests the same page again.
+	for _, response := range []byte{0x21, 0x06} {
+		page := readPacket(t, r, PageLength)
+		if page[0] != 0 || page[1] != 0xFF {
+			t.Fatalf("expected unused records in page 0, got %02X\n", page[:8])
+		}
+		conn.Write([]byte{response})
+	}
+	if page := readPacket(t, r, PageLength); page[0] != 1 {
+		t.Fatalf("expected page 1, got %d\n", page[0])
+	}
+	conn.Write([]byte{0x1B})
+
+	io.WriteString(conn, "TEST\n")
+	expect(t, r, "\n\rTEST\n\r")
+}
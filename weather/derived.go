@@ -0,0 +1,136 @@
+/*
+   rtldavis, an rtl-sdr receiver for Davis Instruments weather stations.
+   Copyright (C) 2015  Douglas Hall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package weather
+
+import "math"
+
+// Derived quantities use the same units as the transmitters: °F, % relative
+// humidity, mph and W/m².
+
+func fToC(f float64) float64 { return (f - 32) * 5 / 9 }
+func cToF(c float64) float64 { return c*9/5 + 32 }
+
+// mphToMS converts wind speed to metres per second.
+const mphToMS = 0.44704
+
+// vaporPressure returns the saturation vapor pressure in hPa at the given
+// temperature in °C.
+func vaporPressure(c float64) float64 {
+	return 6.112 * math.Exp(17.27*c/(c+237.7))
+}
+
+// DewPoint returns the dew point using the Magnus formula.
+func DewPoint(temp, humidity float64) float64 {
+	if humidity <= 0 {
+		humidity = 1
+	}
+
+	c := fToC(temp)
+	g := math.Log(humidity/100) + 17.27*c/(c+237.7)
+	return cToF(237.7 * g / (17.27 - g))
+}
+
+// HeatIndex returns the NOAA heat index: Steadman's simplified formula, or
+// the Rothfusz regression with its adjustments when that's 80°F or more.
+// Below 80°F the heat index is never reported below the temperature, as on
+// a Davis console.
+func HeatIndex(temp, humidity float64) float64 {
+	t, rh := temp, humidity
+
+	hi := 0.5 * (t + 61 + (t-68)*1.2 + rh*0.094)
+	if (hi+t)/2 < 80 {
+		return math.Max(hi, t)
+	}
+
+	hi = -42.379 + 2.04901523*t + 10.14333127*rh -
+		0.22475541*t*rh - 0.00683783*t*t - 0.05481717*rh*rh +
+		0.00122874*t*t*rh + 0.00085282*t*rh*rh - 0.00000199*t*t*rh*rh
+
+	switch {
+	case rh < 13 && t >= 80 && t <= 112:
+		hi -= (13 - rh) / 4 * math.Sqrt((17-math.Abs(t-95))/17)
+	case rh > 85 && t >= 80 && t <= 87:
+		hi += (rh - 85) / 10 * (87 - t) / 5
+	}
+
+	return hi
+}
+
+// WindChill returns the NWS wind chill, defined for temperatures of 50°F or
+// less and wind of at least 3 mph. Otherwise it's the temperature.
+func WindChill(temp, wind float64) float64 {
+	if temp > 50 || wind < 3 {
+		return temp
+	}
+
+	v := math.Pow(wind, 0.16)
+	return math.Min(35.74+0.6215*temp-35.75*v+0.4275*temp*v, temp)
+}
+
+// THWIndex returns Davis' temperature-humidity-wind index: the heat index
+// less 1.072°F per mph of wind.
+func THWIndex(temp, humidity, wind float64) float64 {
+	return HeatIndex(temp, humidity) - 1.072*wind
+}
+
+// THSWIndex returns the THW index warmed by the sun, using the radiation
+// term of Steadman's apparent temperature. The radiation absorbed by a
+// person is taken as a tenth of the global solar radiation.
+func THSWIndex(temp, humidity, wind, solar float64) float64 {
+	q := solar / 10
+	return THWIndex(temp, humidity, wind) + 0.7*q/(wind*mphToMS+10)*9/5
+}
+
+// ApparentTemperature returns the Australian Bureau of Meteorology's
+// apparent temperature in the shade, from Steadman's model.
+func ApparentTemperature(temp, humidity, wind float64) float64 {
+	c := fToC(temp)
+	e := humidity / 100 * vaporPressure(c)
+	return cToF(c + 0.33*e - 0.7*wind*mphToMS - 4)
+}
+
+// ET returns the rate of reference evapotranspiration in inches per hour
+// from the ASCE standardized hourly Penman-Monteith equation for a short
+// crop at sea level. Net longwave radiation depends on cloud cover, which
+// can't be measured without the station's location, so a partly cloudy sky
+// is assumed.
+func ET(temp, humidity, wind, solar float64) float64 {
+	c := fToC(temp)
+	u2 := wind * mphToMS
+
+	es := vaporPressure(c) / 10
+	ea := es * humidity / 100
+	delta := 4098 * es / ((c + 237.3) * (c + 237.3))
+	const gamma = 0.000665 * 101.3
+
+	// Radiation in MJ/m² per hour.
+	rs := solar * 0.0036
+	rnl := 2.042e-10 * math.Pow(c+273.16, 4) * (0.34 - 0.14*math.Sqrt(ea)) * 0.7
+	rn := 0.77*rs - rnl
+
+	// Soil heat flux and surface resistance differ between day and night.
+	g, cd := 0.5*rn, 0.96
+	if solar > 0 {
+		g, cd = 0.1*rn, 0.24
+	}
+
+	et := (0.408*delta*(rn-g) + gamma*37/(c+273)*u2*(es-ea)) /
+		(delta + gamma*(1+cd*u2))
+
+	return math.Max(et, 0) / 25.4
+}
@@ -0,0 +1,224 @@
+/*
+   rtldavis, an rtl-sdr receiver for Davis Instruments weather stations.
+   Copyright (C) 2015  Douglas Hall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package weather
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Rain bucket sizes in inches per tip.
+const (
+	BucketInch = 0.01
+	BucketMM   = 0.2 / 25.4
+)
+
+// ParseBucket parses a rain bucket size such as "0.01in" or "0.2mm",
+// returning inches per tip.
+func ParseBucket(s string) (float64, error) {
+	unit := 1.0
+	switch {
+	case strings.HasSuffix(s, "in"):
+		s = strings.TrimSuffix(s, "in")
+	case strings.HasSuffix(s, "mm"):
+		s, unit = strings.TrimSuffix(s, "mm"), 1/25.4
+	default:
+		return 0, fmt.Errorf("rain bucket size %q needs a unit: in or mm", s)
+	}
+
+	size, err := strconv.ParseFloat(s, 64)
+	if err != nil || size <= 0 {
+		return 0, fmt.Errorf("invalid rain bucket size: %q", s)
+	}
+	return size * unit, nil
+}
+
+const (
+	// counterMask is the range of the transmitter's free-running tip counter.
+	counterMask = 0x7F
+
+	// MaxRainRate is the heaviest rain rate in inches per hour expected to
+	// be sustained between counts, about the heaviest hourly rainfall on
+	// record.
+	MaxRainRate = 12.0
+
+	// StormGap is how long without rain ends a storm.
+	StormGap = 24 * time.Hour
+)
+
+// Rain accumulates rainfall from the transmitter's bucket tip counter. The
+// counter wraps and is only sent every few packets, tips are counted from
+// the difference between successive counts. Totals are in inches and reset
+// at the start of each day, month and year in local time.
+type Rain struct {
+	// Bucket is the rainfall per tip in inches.
+	Bucket float64 `json:"bucket"`
+
+	// Rate is the rain rate in inches per hour.
+	Rate Reading `json:"-"`
+
+	Day   float64 `json:"day"`
+	Month float64 `json:"month"`
+	Year  float64 `json:"year"`
+
+	// Storm is the rain since StormStart, the first tip after at least
+	// StormGap without rain.
+	Storm      float64   `json:"storm"`
+	StormStart time.Time `json:"storm_start"`
+	LastTip    time.Time `json:"last_tip"`
+
+	// The most recent count and when it was received.
+	Count   int       `json:"count"`
+	Updated time.Time `json:"updated"`
+
+	// Current is when the totals were last rolled over, which may be later
+	// than the last count.
+	Current time.Time `json:"current"`
+}
+
+// NewRain returns an empty accumulator for a bucket of the given size.
+func NewRain(bucket float64) Rain {
+	return Rain{Bucket: bucket}
+}
+
+// MaxCounterAge is how long the tip counter may go unseen before the tips
+// since can no longer be counted: at MaxRainRate, 128 tips would wrap the
+// counter and go unnoticed. The next count is taken as a new baseline
+// instead.
+func (r Rain) MaxCounterAge() time.Duration {
+	return time.Duration(float64(counterMask+1) * r.Bucket / MaxRainRate * float64(time.Hour))
+}
+
+// Rollover resets the day's, month's and year's totals if t is in a later
+// day, month or year than they were last current. Totals are rolled over
+// as counts arrive, but also need to be when read or saved as they may not
+// for some time.
+func (r *Rain) Rollover(t time.Time) {
+	last := r.Current
+	if last.IsZero() {
+		last = r.Updated
+	}
+	if !t.After(last) {
+		return
+	}
+
+	if !last.IsZero() {
+		if t.Year() != last.Year() {
+			r.Year = 0
+		}
+		if t.Year() != last.Year() || t.Month() != last.Month() {
+			r.Month = 0
+		}
+		if !sameDay(last, t) {
+			r.Day = 0
+		}
+	}
+	r.Current = t
+}
+
+// Update applies a tip count received at t, returning the number of tips
+// since the previous count. A count lower than the previous one is a wrap
+// unless it arrived too soon, then it's a reset and counts no tips.
+func (r *Rain) Update(count int, t time.Time) (tips int) {
+	r.Rollover(t)
+	if !r.Updated.IsZero() {
+		if age := t.Sub(r.Updated); age >= 0 && age <= r.MaxCounterAge() {
+			tips = (count - r.Count) & counterMask
+
+			// A decrease is only a wrap if there was time for that many
+			// tips, otherwise the transmitter restarted its count.
+			if count < r.Count && float64(tips)*r.Bucket > MaxRainRate*age.Hours() {
+				tips = 0
+			}
+		}
+	}
+	r.Count, r.Updated = count, t
+
+	if tips == 0 {
+		return 0
+	}
+
+	if !r.LastTip.IsZero() && t.Sub(r.LastTip) >= StormGap {
+		r.Storm, r.StormStart = 0, time.Time{}
+	}
+	if r.StormStart.IsZero() {
+		r.StormStart = t
+	}
+	r.LastTip = t
+
+	rain := float64(tips) * r.Bucket
+	r.Day += rain
+	r.Month += rain
+	r.Year += rain
+	r.Storm += rain
+
+	return tips
+}
+
+// InStorm reports whether a storm is in progress at t.
+func (r Rain) InStorm(t time.Time) bool {
+	return !r.StormStart.IsZero() && t.Sub(r.LastTip) < StormGap
+}
+
+// Tips converts an amount of rain to bucket tips, which is how a console
+// reports it.
+func (r Rain) Tips(inches float64) int {
+	return int(inches/r.Bucket + 0.5)
+}
+
+// LoadRain reads rain totals saved by Save.
+func LoadRain(name string) (r Rain, err error) {
+	buf, err := ioutil.ReadFile(name)
+	if err != nil {
+		return r, err
+	}
+	err = json.Unmarshal(buf, &r)
+	return r, err
+}
+
+// Save writes the rain totals to the named file. The file is replaced
+// atomically so a crash while saving doesn't lose the previous totals.
+func (r Rain) Save(name string) error {
+	buf, err := json.MarshalIndent(r, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(name), filepath.Base(name)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmp.Write(buf); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), name)
+}
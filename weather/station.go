@@ -0,0 +1,113 @@
+/*
+   rtldavis, an rtl-sdr receiver for Davis Instruments weather stations.
+   Copyright (C) 2015  Douglas Hall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package weather
+
+import (
+	"sync"
+	"time"
+
+	"github.com/bemasher/rtldavis/protocol"
+)
+
+// Value is a quantity derived or accumulated from the readings, keyed like
+// protocol.Sensor.Key.
+type Value struct {
+	Key   string
+	Unit  string
+	Value float64
+	Time  time.Time
+}
+
+// Values returns the derived values, wind averages, ET and rain totals of
+// the current conditions that are known.
+func (c Conditions) Values() (values []Value) {
+	add := func(key, unit string, r Reading) {
+		if r.Valid() {
+			values = append(values, Value{key, unit, r.Value, r.Time})
+		}
+	}
+
+	add("dew_point", "°F", c.DewPoint)
+	add("heat_index", "°F", c.HeatIndex)
+	add("wind_chill", "°F", c.WindChill)
+	add("thw_index", "°F", c.THWIndex)
+	add("thsw_index", "°F", c.THSWIndex)
+	add("apparent_temperature", "°F", c.ApparentTemp)
+
+	add("wind_speed_2m", "mph", c.WindSpeedShort)
+	add("wind_speed_10m", "mph", c.WindSpeedLong)
+	add("wind_direction_10m", "°", c.WindDirectionLong)
+	add("wind_gust_10m", "mph", c.WindGustLong)
+	add("wind_gust_direction_10m", "°", c.WindGustDirection)
+
+	add("day_et", "in", c.DayET)
+
+	add("rain_rate", "in/h", c.Rain.Rate)
+	if t := c.Rain.Updated; !t.IsZero() {
+		add("rain_day", "in", Reading{c.Rain.Day, t})
+		add("rain_month", "in", Reading{c.Rain.Month, t})
+		add("rain_year", "in", Reading{c.Rain.Year, t})
+		add("rain_storm", "in", Reading{c.Rain.Storm, t})
+	}
+
+	return values
+}
+
+// Sink consumes the current conditions each time a message updates them.
+type Sink interface {
+	WriteConditions(c Conditions) error
+}
+
+// Station is a sink keeping the current conditions up to date from decoded
+// messages, passing them on to its sinks after each message.
+type Station struct {
+	mu    sync.Mutex
+	c     Conditions
+	sinks []Sink
+}
+
+func NewStation(c Conditions, sinks ...Sink) *Station {
+	return &Station{c: c, sinks: sinks}
+}
+
+// Write applies a message to the current conditions and writes them to
+// each of the station's sinks.
+func (s *Station) Write(msg protocol.Message) (err error) {
+	s.mu.Lock()
+	s.c.Update(msg)
+	c := s.c
+	s.mu.Unlock()
+
+	for _, sink := range s.sinks {
+		if serr := sink.WriteConditions(c); err == nil {
+			err = serr
+		}
+	}
+	return err
+}
+
+// Conditions returns a copy of the current conditions, with rain totals
+// rolled over to now.
+func (s *Station) Conditions() Conditions {
+	s.mu.Lock()
+	c := s.c
+	s.mu.Unlock()
+
+	c.Rain.Rollover(time.Now())
+	return c
+}
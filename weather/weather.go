@@ -0,0 +1,258 @@
+/*
+   rtldavis, an rtl-sdr receiver for Davis Instruments weather stations.
+   Copyright (C) 2015  Douglas Hall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package weather
+
+import (
+	"time"
+
+	"github.com/bemasher/rtldavis/protocol"
+)
+
+// Reading is the most recent value of a quantity and the time it was
+// received.
+type Reading struct {
+	Value float64
+	Time  time.Time
+}
+
+// Valid reports whether the reading has ever been received.
+func (r Reading) Valid() bool {
+	return !r.Time.IsZero()
+}
+
+func (r *Reading) set(value float64, t time.Time) {
+	r.Value = value
+	r.Time = t
+}
+
+// Extremes tracks the high and low of a quantity since the start of the day.
+type Extremes struct {
+	High, Low Reading
+}
+
+func (e *Extremes) update(r Reading) {
+	if !e.High.Valid() || r.Value > e.High.Value {
+		e.High = r
+	}
+	if !e.Low.Valid() || r.Value < e.Low.Value {
+		e.Low = r
+	}
+}
+
+// Conditions are the current conditions a console would display, maintained
+// from the stream of decoded messages. Each transmitter only sends one sensor
+// per message so readings are updated as they arrive.
+type Conditions struct {
+	// ISSID is the transmitter outside temperature, humidity, rain, UV,
+	// solar radiation and supercap readings are taken from, so those of
+	// other stations such as temperature/humidity stations don't overwrite
+	// them. If negative, they're taken from every transmitter.
+	ISSID int
+
+	// WindID is the transmitter wind readings are taken from. Every message
+	// carries wind speed and direction, including from transmitters without
+	// an anemometer which report calm. If negative, wind is taken from every
+	// transmitter that has reported any wind.
+	WindID int
+
+	// windHeard has bit n set once transmitter n has reported wind.
+	windHeard byte
+
+	// Wind keeps recent wind readings and decodes their direction.
+	Wind Wind
+
+	OutsideTemp     Reading // °F
+	OutsideHumidity Reading // %
+	WindSpeed       Reading // mph
+	WindDirection   Reading // degrees
+	WindGustSpeed   Reading // mph
+	RainRate        Reading // bucket tips per hour
+	UVIndex         Reading
+	SolarRadiation  Reading // W/m²
+	SuperCapVoltage Reading // V
+
+	// Derived from the readings above as they arrive, as a console would.
+	DewPoint     Reading // °F
+	HeatIndex    Reading // °F
+	WindChill    Reading // °F
+	THWIndex     Reading // °F
+	THSWIndex    Reading // °F
+	ApparentTemp Reading // °F
+
+	// Wind averaged over ShortWindPeriod and LongWindPeriod in mph, the
+	// vector mean direction over LongWindPeriod, and the strongest gust
+	// over LongWindPeriod and its direction.
+	WindSpeedShort    Reading
+	WindSpeedLong     Reading
+	WindDirectionLong Reading
+	WindGustLong      Reading
+	WindGustDirection Reading
+
+	// DayET is the reference evapotranspiration since midnight, in inches.
+	DayET Reading
+
+	Rain Rain
+
+	// BatteryLow has bit n set while the transmitter with id n reports a
+	// low battery.
+	BatteryLow byte
+
+	DayOutsideTemp     Extremes
+	DayOutsideHumidity Extremes
+	DayWindSpeed       Extremes
+
+	// The time of the most recent message.
+	Updated time.Time
+}
+
+// maxETInterval is the longest gap between messages over which ET is
+// accumulated, past it the readings are too stale to integrate.
+const maxETInterval = 5 * time.Minute
+
+// NewConditions returns empty conditions taking outside readings from the
+// ISS and wind readings from the given transmitters, with rain measured by a
+// 0.01in bucket.
+func NewConditions(issID, windID int) Conditions {
+	return Conditions{ISSID: issID, WindID: windID, Rain: NewRain(BucketInch)}
+}
+
+// Update applies a message to the current conditions.
+func (c *Conditions) Update(msg protocol.Message) {
+	t := msg.Time
+
+	// Daily extremes and totals reset at local midnight.
+	since := c.Updated
+	if !c.Updated.IsZero() && !sameDay(c.Updated, t) {
+		c.DayOutsideTemp = Extremes{}
+		c.DayOutsideHumidity = Extremes{}
+		c.DayWindSpeed = Extremes{}
+		c.DayET = Reading{}
+
+		y, m, d := t.Date()
+		since = time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+	}
+
+	// ET accumulates at the rate given by the readings since the last
+	// message, or since midnight if that was yesterday.
+	if dt := t.Sub(c.Updated); !c.Updated.IsZero() && dt > 0 && dt <= maxETInterval &&
+		c.OutsideTemp.Valid() && c.OutsideHumidity.Valid() && c.WindSpeed.Valid() && c.SolarRadiation.Valid() {
+		rate := ET(c.OutsideTemp.Value, c.OutsideHumidity.Value, c.WindSpeed.Value, c.SolarRadiation.Value)
+		c.DayET.set(c.DayET.Value+rate*t.Sub(since).Hours(), t)
+	}
+	c.Updated = t
+
+	if msg.BatteryLow {
+		c.BatteryLow |= 1 << msg.ID
+	} else {
+		c.BatteryLow &^= 1 << msg.ID
+	}
+
+	if msg.WindSpeed != 0 {
+		c.windHeard |= 1 << msg.ID
+	}
+	wind := int(msg.ID) == c.WindID || c.WindID < 0 && c.windHeard&(1<<msg.ID) != 0
+	iss := int(msg.ID) == c.ISSID || c.ISSID < 0
+
+	if wind {
+		c.WindSpeed.set(float64(msg.WindSpeed), t)
+		c.DayWindSpeed.update(c.WindSpeed)
+		c.WindDirection.set(c.Wind.Direction(msg.WindDirection), t)
+		c.Wind.Add(c.WindSpeed.Value, c.WindDirection.Value, t)
+
+		if msg.Valid && msg.Sensor == protocol.WindGustSpeed {
+			c.Wind.AddGust(msg.Value, t)
+		}
+		c.averageWind(t)
+	}
+
+	if msg.Valid && (msg.Sensor == protocol.WindGustSpeed && wind || msg.Sensor != protocol.WindGustSpeed && iss) {
+		c.update(msg.Sensor, msg.Value, t)
+	}
+	c.derive(t)
+}
+
+func (c *Conditions) update(sensor protocol.Sensor, value float64, t time.Time) {
+	switch sensor {
+	case protocol.Temperature:
+		c.OutsideTemp.set(value, t)
+		c.DayOutsideTemp.update(c.OutsideTemp)
+	case protocol.Humidity:
+		c.OutsideHumidity.set(value, t)
+		c.DayOutsideHumidity.update(c.OutsideHumidity)
+	case protocol.WindGustSpeed:
+		c.WindGustSpeed.set(value, t)
+	case protocol.RainRate:
+		c.RainRate.set(value, t)
+		c.Rain.Rate.set(value*c.Rain.Bucket, t)
+	case protocol.Rain:
+		c.Rain.Update(int(value), t)
+	case protocol.UVIndex:
+		c.UVIndex.set(value, t)
+	case protocol.SolarRadiation:
+		c.SolarRadiation.set(value, t)
+	case protocol.SuperCapVoltage:
+		c.SuperCapVoltage.set(value, t)
+	}
+}
+
+// averageWind updates the wind averages and gust.
+func (c *Conditions) averageWind(t time.Time) {
+	if speed, _, ok := c.Wind.Average(ShortWindPeriod, t); ok {
+		c.WindSpeedShort.set(speed, t)
+	}
+	if speed, direction, ok := c.Wind.Average(LongWindPeriod, t); ok {
+		c.WindSpeedLong.set(speed, t)
+		c.WindDirectionLong.set(direction, t)
+	}
+	if speed, direction, ok := c.Wind.Gust(LongWindPeriod, t); ok {
+		c.WindGustLong.set(speed, t)
+		c.WindGustDirection.set(direction, t)
+	}
+}
+
+// derive updates the derived quantities from whichever readings they
+// depend on have been received.
+func (c *Conditions) derive(t time.Time) {
+	temp, humidity, wind := c.OutsideTemp.Value, c.OutsideHumidity.Value, c.WindSpeed.Value
+	haveTemp, haveHumidity, haveWind := c.OutsideTemp.Valid(), c.OutsideHumidity.Valid(), c.WindSpeed.Valid()
+
+	if haveTemp && haveWind {
+		c.WindChill.set(WindChill(temp, wind), t)
+	}
+	if !haveTemp || !haveHumidity {
+		return
+	}
+
+	c.DewPoint.set(DewPoint(temp, humidity), t)
+	c.HeatIndex.set(HeatIndex(temp, humidity), t)
+	if !haveWind {
+		return
+	}
+
+	c.THWIndex.set(THWIndex(temp, humidity, wind), t)
+	c.ApparentTemp.set(ApparentTemperature(temp, humidity, wind), t)
+	if c.SolarRadiation.Valid() {
+		c.THSWIndex.set(THSWIndex(temp, humidity, wind, c.SolarRadiation.Value), t)
+	}
+}
+
+func sameDay(a, b time.Time) bool {
+	ay, am, ad := a.Date()
+	by, bm, bd := b.Date()
+	return ay == by && am == bm && ad == bd
+}
@@ -0,0 +1,338 @@
+package weather
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bemasher/rtldavis/dsp"
+	"github.com/bemasher/rtldavis/protocol"
+)
+
+func TestDerived(t *testing.T) {
+	// Expected values from the NWS heat index and wind chill tables and
+	// published dew point tables.
+	cases := []struct {
+		name     string
+		f        func() float64
+		expected float64
+	}{
+		{"DewPoint(68, 50)", func() float64 { return DewPoint(68, 50) }, 48.7},
+		{"DewPoint(90, 100)", func() float64 { return DewPoint(90, 100) }, 90},
+		{"HeatIndex(90, 60)", func() float64 { return HeatIndex(90, 60) }, 100},
+		{"HeatIndex(100, 40)", func() float64 { return HeatIndex(100, 40) }, 109},
+		{"HeatIndex(70, 50)", func() float64 { return HeatIndex(70, 50) }, 70},
+		{"WindChill(0, 15)", func() float64 { return WindChill(0, 15) }, -19},
+		{"WindChill(30, 20)", func() float64 { return WindChill(30, 20) }, 17},
+		{"WindChill(60, 20)", func() float64 { return WindChill(60, 20) }, 60},
+		{"THWIndex(90, 60, 10)", func() float64 { return THWIndex(90, 60, 10) }, 89.5},
+		{"ApparentTemperature(86, 50, 0)", func() float64 { return ApparentTemperature(86, 50, 0) }, 91.4},
+	}
+
+	for _, c := range cases {
+		if v := c.f(); math.Abs(v-c.expected) > 0.6 {
+			t.Fatalf("%s: expected %0.1f, got %0.2f\n", c.name, c.expected, v)
+		}
+	}
+
+	// The sun warms, but only by day.
+	if thsw, thw := THSWIndex(80, 50, 5, 800), THWIndex(80, 50, 5); thsw < thw+5 || thsw > thw+15 {
+		t.Fatalf("expected THSW a few degrees above THW %0.1f, got %0.1f\n", thw, thsw)
+	}
+	if THSWIndex(80, 50, 5, 0) != THWIndex(80, 50, 5) {
+		t.Fatalf("expected THSW equal to THW at night\n")
+	}
+
+	// A hot, dry, sunny and breezy hour evaporates most, a still humid night
+	// almost nothing.
+	if et := ET(90, 20, 10, 900); et < 0.025 || et > 0.045 {
+		t.Fatalf("expected ET around 0.035in/h, got %0.4f\n", et)
+	}
+	if et := ET(60, 95, 0, 0); et > 0.001 {
+		t.Fatalf("expected ET near zero at night, got %0.4f\n", et)
+	}
+}
+
+// message returns a message from transmitter 0 with the given reading and
+// 5mph of wind.
+func message(at time.Time, sensor protocol.Sensor, data byte) protocol.Message {
+	msg := protocol.NewMessage(dsp.Packet{Data: []byte{0xCB, 0x89, byte(sensor) << 4, 0x05, 0x4A, data, 0x50, 0x00, 0x12, 0x34}})
+	msg.Time = at
+	return msg
+}
+
+func TestConditions(t *testing.T) {
+	c := NewConditions(0, 0)
+	start := time.Date(2015, 6, 1, 12, 0, 0, 0, time.Local)
+
+	// Temperature alone gives wind chill, humidity the rest bar THSW which
+	// needs solar radiation.
+	c.Update(message(start, protocol.Temperature, 0x2D))
+	if !c.WindChill.Valid() || c.DewPoint.Valid() {
+		t.Fatalf("expected only wind chill from temperature: %+v\n", c)
+	}
+
+	msg := message(start.Add(time.Second), protocol.Humidity, 0)
+	msg.Valid, msg.Value = true, 50
+	c.Update(msg)
+	if !c.DewPoint.Valid() || !c.HeatIndex.Valid() || !c.THWIndex.Valid() || !c.ApparentTemp.Valid() || c.THSWIndex.Valid() {
+		t.Fatalf("expected all but THSW once humidity is known: %+v\n", c)
+	}
+	if expected := DewPoint(c.OutsideTemp.Value, 50); c.DewPoint.Value != expected {
+		t.Fatalf("expected dew point %0.1f, got %0.1f\n", expected, c.DewPoint.Value)
+	}
+
+	msg = message(start.Add(2*time.Second), protocol.SolarRadiation, 0)
+	msg.Valid, msg.Value = true, 800
+	c.Update(msg)
+	if !c.THSWIndex.Valid() || c.DayET.Valid() {
+		t.Fatalf("expected THSW and no ET yet: %+v\n", c)
+	}
+
+	// ET accumulates over time at the current rate, except across gaps too
+	// long to trust.
+	rate := ET(c.OutsideTemp.Value, 50, 5, 800)
+	for n := 1; n <= 60; n++ {
+		msg.Time = start.Add(2*time.Second + time.Duration(n)*time.Minute)
+		c.Update(msg)
+	}
+	if math.Abs(c.DayET.Value-rate) > 1e-9 {
+		t.Fatalf("expected ET %0.4f after an hour, got %0.4f\n", rate, c.DayET.Value)
+	}
+
+	msg.Time = msg.Time.Add(time.Hour)
+	c.Update(msg)
+	if math.Abs(c.DayET.Value-rate) > 1e-9 {
+		t.Fatalf("expected ET %0.4f after a gap, got %0.4f\n", rate, c.DayET.Value)
+	}
+
+	// ET resets at midnight.
+	msg.Time = start.Add(24 * time.Hour)
+	c.Update(msg)
+	if c.DayET.Valid() {
+		t.Fatalf("expected ET reset at midnight, got %0.4f\n", c.DayET.Value)
+	}
+
+	// The interval crossing midnight counts from midnight towards the new
+	// day.
+	msg.Time = time.Date(2015, 6, 2, 23, 58, 0, 0, time.Local)
+	c.Update(msg)
+	msg.Time = msg.Time.Add(4 * time.Minute)
+	c.Update(msg)
+	if expected := rate * 2 / 60; math.Abs(c.DayET.Value-expected) > 1e-9 || !c.DayET.Time.Equal(msg.Time) {
+		t.Fatalf("expected ET %0.4f since midnight, got %0.4f\n", expected, c.DayET.Value)
+	}
+}
+
+func TestConditionsIDs(t *testing.T) {
+	c := NewConditions(0, -1)
+	start := time.Date(2015, 6, 1, 12, 0, 0, 0, time.Local)
+
+	c.Update(message(start, protocol.Temperature, 0x2D))
+
+	// A temperature/humidity station on transmitter 1 reports calm and its
+	// own temperature.
+	msg := message(start.Add(time.Second), protocol.Temperature, 0x40)
+	msg.Data[0] |= 1
+	msg.ID, msg.WindSpeed = 1, 0
+	c.Update(msg)
+	if c.OutsideTemp.Value != 72.5 {
+		t.Fatalf("expected outside temperature from the ISS, got %0.1f\n", c.OutsideTemp.Value)
+	}
+	if c.WindSpeed.Value != 5 || c.WindSpeedShort.Value != 5 {
+		t.Fatalf("expected wind of 5mph from the ISS, got %0.1f averaging %0.1f\n", c.WindSpeed.Value, c.WindSpeedShort.Value)
+	}
+
+	// Once it reports wind it has an anemometer.
+	msg.Time, msg.WindSpeed = msg.Time.Add(time.Second), 11
+	c.Update(msg)
+	if c.WindSpeed.Value != 11 {
+		t.Fatalf("expected wind of 11mph from transmitter 1, got %0.1f\n", c.WindSpeed.Value)
+	}
+}
+
+func TestRain(t *testing.T) {
+	r := NewRain(BucketInch)
+	start := time.Date(2015, 6, 30, 12, 0, 0, 0, time.Local)
+
+	// The first count is a baseline.
+	if tips := r.Update(120, start); tips != 0 {
+		t.Fatalf("expected no tips from the first count, got %d\n", tips)
+	}
+
+	// The counter wraps, and counts are missed.
+	for _, c := range []struct {
+		count, tips int
+	}{{125, 5}, {3, 6}, {3, 0}, {10, 7}} {
+		start = start.Add(time.Minute)
+		if tips := r.Update(c.count, start); tips != c.tips {
+			t.Fatalf("count %d: expected %d tips, got %d\n", c.count, c.tips, tips)
+		}
+	}
+	if r.Tips(r.Day) != 18 || r.Tips(r.Storm) != 18 || !r.InStorm(start) {
+		t.Fatalf("expected 18 tips today and this storm: %+v\n", r)
+	}
+
+	// A decrease too soon to be a wrap is the transmitter restarting its
+	// count.
+	start = start.Add(time.Minute)
+	if tips := r.Update(5, start); tips != 0 || r.Tips(r.Day) != 18 {
+		t.Fatalf("expected a reset to count no tips, got %d: %+v\n", tips, r)
+	}
+
+	// Too long a gap and the counter may have wrapped, so it's a new
+	// baseline.
+	start = start.Add(2 * r.MaxCounterAge())
+	if tips := r.Update(50, start); tips != 0 {
+		t.Fatalf("expected no tips after a gap, got %d\n", tips)
+	}
+
+	// Totals survive a restart without double counting.
+	dir, err := ioutil.TempDir("", "rtldavis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "rain")
+	if err := r.Save(name); err != nil {
+		t.Fatal(err)
+	}
+	r, err = LoadRain(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start = start.Add(time.Minute)
+	if tips := r.Update(51, start); tips != 1 || r.Tips(r.Day) != 19 {
+		t.Fatalf("expected 1 tip and 19 today after reloading, got %d: %+v\n", tips, r)
+	}
+
+	// A new day and month, and more than a day without rain starts a new
+	// storm. The year carries on.
+	start = start.Add(36 * time.Hour)
+	r.Update(51, start.Add(-time.Minute))
+	if tips := r.Update(53, start); tips != 2 {
+		t.Fatalf("expected 2 tips, got %d\n", tips)
+	}
+	if r.Tips(r.Day) != 2 || r.Tips(r.Month) != 2 || r.Tips(r.Storm) != 2 || r.Tips(r.Year) != 21 || !r.StormStart.Equal(start) {
+		t.Fatalf("expected totals reset: %+v\n", r)
+	}
+
+	// Totals roll over when read, even if no count has arrived since.
+	r.Rollover(start.Add(time.Minute))
+	if r.Tips(r.Day) != 2 {
+		t.Fatalf("expected 2 tips today, got %d\n", r.Tips(r.Day))
+	}
+	r.Rollover(start.Add(24 * time.Hour))
+	if r.Day != 0 || r.Tips(r.Year) != 21 {
+		t.Fatalf("expected the day's total reset: %+v\n", r)
+	}
+
+	// A count can't be told from one 128 tips later once the heaviest rain
+	// could have tipped the bucket that often.
+	if age := NewRain(BucketMM).MaxCounterAge(); age < 5*time.Minute || age > 10*time.Minute {
+		t.Fatalf("expected a maximum counter age of several minutes, got %s\n", age)
+	}
+
+	if b, err := ParseBucket("0.2mm"); err != nil || b != BucketMM {
+		t.Fatalf("expected %f, got %f %v\n", BucketMM, b, err)
+	}
+	if _, err := ParseBucket("0.2"); err == nil {
+		t.Fatalf("expected error for bucket size without a unit\n")
+	}
+}
+
+func TestWind(t *testing.T) {
+	for _, c := range []struct {
+		encoding WindEncoding
+		offset   float64
+		raw      byte
+		expected float64
+	}{
+		{Pro2, 0, 0, 9},
+		{Pro2, 0, 255, 351},
+		{Pro2, 0, 128, 180.7},
+		{Vue, 0, 0, 0.3},
+		{Vue, 0, 128, 180.3},
+		{Vue, 0, 255, 358.9},
+		{Vue, 10, 255, 8.9},
+		{Pro2, -20, 0, 349},
+	} {
+		w := Wind{Encoding: c.encoding, Offset: c.offset}
+		if d := w.Direction(c.raw); math.Abs(d-c.expected) > 0.05 {
+			t.Fatalf("%s%+.0f: expected %d to be %0.1f°, got %0.2f°\n", c.encoding, c.offset, c.raw, c.expected, d)
+		}
+	}
+
+	var w Wind
+	start := time.Unix(0, 0)
+
+	// Eight minutes of 10mph from 350°, then two of 4mph from 10°.
+	for n := 0; n < 40; n++ {
+		at := start.Add(time.Duration(n) * 15 * time.Second)
+		if n < 32 {
+			w.Add(10, 350, at)
+		} else {
+			w.Add(4, 10, at)
+		}
+	}
+	now := start.Add(39 * 15 * time.Second)
+	w.AddGust(25, now.Add(-9*time.Minute))
+
+	if speed, direction, _ := w.Average(ShortWindPeriod, now); speed != 4 || math.Abs(direction-10) > 1e-9 {
+		t.Fatalf("expected 2 minute average 4mph from 10°, got %0.1fmph from %0.1f°\n", speed, direction)
+	}
+
+	// The vector mean of mostly 350° and a little 10° is just west of
+	// north, not the arithmetic mean of 180°.
+	speed, direction, _ := w.Average(LongWindPeriod, now)
+	if speed != 8.8 || direction < 350 || direction > 355 {
+		t.Fatalf("expected 10 minute average 8.8mph from 350-355°, got %0.1fmph from %0.1f°\n", speed, direction)
+	}
+
+	if speed, direction, _ := w.Gust(LongWindPeriod, now); speed != 25 || direction != 350 {
+		t.Fatalf("expected 25mph gust from 350°, got %0.1fmph from %0.1f°\n", speed, direction)
+	}
+
+	// Readings older than the longest period are forgotten.
+	later := now.Add(LongWindPeriod)
+	w.Add(0, 90, later)
+	if speed, direction, _ := w.Gust(LongWindPeriod, later); speed != 0 || direction != 90 || len(w.samples) != 1 {
+		t.Fatalf("expected old readings pruned, got gust %0.1fmph from %0.1f°: %+v\n", speed, direction, w)
+	}
+}
+
+// sinkFunc adapts a function to a Sink.
+type sinkFunc func(Conditions) error
+
+func (f sinkFunc) WriteConditions(c Conditions) error { return f(c) }
+
+func TestStation(t *testing.T) {
+	var written []Conditions
+	s := NewStation(NewConditions(0, 0), sinkFunc(func(c Conditions) error {
+		written = append(written, c)
+		return nil
+	}))
+
+	start := time.Date(2015, 6, 1, 12, 0, 0, 0, time.Local)
+	s.Write(message(start, protocol.Temperature, 0x2D))
+	if len(written) != 1 || !written[0].WindChill.Valid() {
+		t.Fatalf("expected conditions with wind chill, got %+v\n", written)
+	}
+
+	values := make(map[string]Value)
+	for _, v := range s.Conditions().Values() {
+		values[v.Key] = v
+	}
+	for _, key := range []string{"wind_chill", "wind_speed_2m", "wind_speed_10m", "wind_direction_10m"} {
+		if v, ok := values[key]; !ok || !v.Time.Equal(start) {
+			t.Fatalf("expected %s at %s, got %+v\n", key, start, values)
+		}
+	}
+	if _, ok := values["dew_point"]; ok {
+		t.Fatalf("expected no dew point without humidity, got %+v\n", values)
+	}
+}
@@ -0,0 +1,183 @@
+/*
+   rtldavis, an rtl-sdr receiver for Davis Instruments weather stations.
+   Copyright (C) 2015  Douglas Hall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package weather
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// WindEncoding is how a station's anemometer encodes wind direction in the
+// direction byte.
+type WindEncoding int
+
+const (
+	// Pro2 anemometers have a dead band at north, the byte spans 9° to
+	// 351°.
+	Pro2 WindEncoding = iota
+
+	// Vue anemometers span the full circle in 256 steps.
+	Vue
+)
+
+func (e WindEncoding) String() string {
+	switch e {
+	case Pro2:
+		return "pro2"
+	case Vue:
+		return "vue"
+	}
+	return fmt.Sprintf("WindEncoding(%d)", int(e))
+}
+
+// ParseWindEncoding parses the name of a wind direction encoding, pro2 or
+// vue.
+func ParseWindEncoding(s string) (WindEncoding, error) {
+	switch s {
+	case "pro2":
+		return Pro2, nil
+	case "vue":
+		return Vue, nil
+	}
+	return 0, fmt.Errorf("unknown wind encoding: %q", s)
+}
+
+// Wind averaging periods, as reported by a console.
+const (
+	ShortWindPeriod = 2 * time.Minute
+	LongWindPeriod  = 10 * time.Minute
+)
+
+type windSample struct {
+	t         time.Time
+	speed     float64
+	direction float64
+}
+
+// Wind keeps the last LongWindPeriod of wind readings for averages and
+// gusts.
+type Wind struct {
+	Encoding WindEncoding
+
+	// Offset is added to every direction to correct for an anemometer that
+	// isn't aligned with north.
+	Offset float64
+
+	samples []windSample
+	gusts   []windSample
+}
+
+// Direction decodes a direction byte to degrees clockwise from north.
+func (w Wind) Direction(raw byte) float64 {
+	var d float64
+	switch w.Encoding {
+	case Vue:
+		d = float64(raw)*360/256 + 0.3
+	default:
+		d = 9 + float64(raw)*342/255
+	}
+
+	d = math.Mod(d+w.Offset, 360)
+	if d < 0 {
+		d += 360
+	}
+	return d
+}
+
+// Add records a wind reading at t.
+func (w *Wind) Add(speed, direction float64, t time.Time) {
+	w.samples = append(prune(w.samples, t), windSample{t, speed, direction})
+}
+
+// AddGust records a gust reported by the transmitter at t.
+func (w *Wind) AddGust(speed float64, t time.Time) {
+	w.gusts = append(prune(w.gusts, t), windSample{t: t, speed: speed})
+}
+
+// prune drops samples older than LongWindPeriod. Samples are only ever
+// resliced or appended, never modified in place, so copies of a Wind stay
+// valid.
+func prune(samples []windSample, t time.Time) []windSample {
+	idx := 0
+	for idx < len(samples) && t.Sub(samples[idx].t) >= LongWindPeriod {
+		idx++
+	}
+	return samples[idx:]
+}
+
+// Average returns the mean wind speed over the period ending at t and the
+// vector mean direction, weighted by speed. ok is false if there are no
+// readings in the period.
+func (w Wind) Average(period time.Duration, t time.Time) (speed, direction float64, ok bool) {
+	var n, x, y, calmX, calmY float64
+	for _, s := range w.samples {
+		if t.Sub(s.t) >= period || s.t.After(t) {
+			continue
+		}
+
+		rad := s.direction * math.Pi / 180
+		n++
+		speed += s.speed
+		x += s.speed * math.Sin(rad)
+		y += s.speed * math.Cos(rad)
+		calmX += math.Sin(rad)
+		calmY += math.Cos(rad)
+	}
+
+	if n == 0 {
+		return 0, 0, false
+	}
+
+	// With no wind at all the vane still points somewhere.
+	if x == 0 && y == 0 {
+		x, y = calmX, calmY
+	}
+
+	direction = math.Atan2(x, y) * 180 / math.Pi
+	if direction < 0 {
+		direction += 360
+	}
+	return speed / n, direction, true
+}
+
+// Gust returns the highest wind speed over the period ending at t and its
+// direction, from both wind readings and the gusts reported by the
+// transmitter. Reported gusts don't carry a direction, the direction of the
+// strongest reading is used.
+func (w Wind) Gust(period time.Duration, t time.Time) (speed, direction float64, ok bool) {
+	for _, s := range w.samples {
+		if t.Sub(s.t) >= period || s.t.After(t) {
+			continue
+		}
+		if !ok || s.speed > speed {
+			speed, direction, ok = s.speed, s.direction, true
+		}
+	}
+
+	for _, s := range w.gusts {
+		if t.Sub(s.t) >= period || s.t.After(t) {
+			continue
+		}
+		if !ok || s.speed > speed {
+			speed, ok = s.speed, true
+		}
+	}
+
+	return speed, direction, ok
+}